@@ -26,10 +26,11 @@
 package datastore
 
 import (
+	"reflect"
 	"strings"
 
-	"labix.org/v2/mgo"
-	"labix.org/v2/mgo/bson"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
 	"upper.io/db"
 	"upper.io/db/util"
 
@@ -81,9 +82,7 @@ func (self *Collection) Find(terms ...interface{}) db.Result {
 
 	queryChunks.Conditions = self.compileQuery(terms...)
 
-	if debugEnabled() == true {
-		debugLogQuery(queryChunks)
-	}
+	self.parent.logQuery(queryChunks)
 
 	// Actually executing query.
 	result := &Result{
@@ -216,6 +215,46 @@ func (self *Collection) Truncate() error {
 	return nil
 }
 
+// Appends the items of a slice one by one.
+func (self *Collection) AppendAll(items interface{}) ([]interface{}, error) {
+	items_v := reflect.ValueOf(items)
+
+	if items_v.Kind() == reflect.Ptr {
+		items_v = items_v.Elem()
+	}
+
+	if items_v.Kind() != reflect.Slice {
+		return nil, db.ErrExpectingSliceMapStruct
+	}
+
+	ids := make([]interface{}, 0, items_v.Len())
+
+	for i := 0; i < items_v.Len(); i++ {
+		id, err := self.Append(items_v.Index(i).Interface())
+		if err != nil {
+			return ids, err
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, nil
+}
+
+// Upserts are not supported by this adapter.
+func (self *Collection) Upsert(cond db.Cond, item interface{}) error {
+	return db.ErrFeatureNotSupported
+}
+
+// Lookups by key are not supported by this adapter.
+func (self *Collection) Get(id interface{}, dst interface{}) error {
+	return db.ErrFeatureNotSupported
+}
+
+// Returns an empty key, entities are keyed by datastore keys instead.
+func (self *Collection) PrimaryKey() []string {
+	return []string{}
+}
+
 // Appends an item (map or struct) into the collection.
 func (self *Collection) Append(item interface{}) (interface{}, error) {
 	ctx := self.parent.Context()
@@ -26,8 +26,8 @@
 package datastore
 
 import (
-	"log"
-	"os"
+	"context"
+	"fmt"
 	"strings"
 
 	"appengine"
@@ -41,21 +41,26 @@ const (
 
 type Source struct {
 	config db.Settings
-}
-
-func debugEnabled() bool {
-	if os.Getenv(db.EnvEnableDebug) != "" {
-		return true
-	}
-	return false
+	logger db.Logger
 }
 
 func init() {
 	db.Register(driverName, &Source{})
 }
 
-func debugLogQuery(c *chunks) {
-	log.Printf("Fields: %v\nLimit: %v\nOffset: %v\nSort: %v\nConditions: %v\n", c.Fields, c.Limit, c.Offset, c.Sort, c.Conditions)
+// Sends a query to the logger of this source, if any.
+func (self *Source) logQuery(c *chunks) {
+	logger := self.logger
+	if logger == nil {
+		if logger = db.GetLogger(); logger == nil {
+			return
+		}
+	}
+	logger.Log(&db.QueryStatus{
+		Adapter:      driverName,
+		Query:        fmt.Sprintf("Fields: %v\nLimit: %v\nOffset: %v\nSort: %v\nConditions: %v", c.Fields, c.Limit, c.Offset, c.Sort, c.Conditions),
+		RowsAffected: -1,
+	})
 }
 
 // Returns the string name of the database.
@@ -87,6 +92,32 @@ func (self *Source) Open() error {
 	return nil
 }
 
+// Clones the current database session.
+func (self *Source) Clone() (db.Database, error) {
+	clone := &Source{}
+	clone.config = self.config
+	return clone, nil
+}
+
+// The datastore is always reachable within an appengine context.
+func (self *Source) Ping() error {
+	return nil
+}
+
+// The datastore has no connection pool.
+func (self *Source) Stats() db.Stats {
+	return db.Stats{}
+}
+
+// Sets the logger that receives the queries of this source.
+func (self *Source) SetLogger(logger db.Logger) {
+	self.logger = logger
+}
+
+// Query timings are not tracked by this adapter.
+func (self *Source) SetSlowQueryReport(report *db.SlowQueryReport) {
+}
+
 // Closes the current database session. Resets to default namespace.
 func (self *Source) Close() error {
 	if self.session != nil {
@@ -112,6 +143,26 @@ func (self *Source) End() error {
 	return nil
 }
 
+// Queries are run within the appengine context given in db.Settings.
+func (self *Source) WithContext(ctx context.Context) db.Database {
+	return self
+}
+
+// Raw queries are not supported by this adapter.
+func (self *Source) Query(query string, args ...interface{}) (db.Iterator, error) {
+	return nil, db.ErrFeatureNotSupported
+}
+
+// Raw statements are not supported by this adapter.
+func (self *Source) Exec(query string, args ...interface{}) (db.ExecResult, error) {
+	return nil, db.ErrFeatureNotSupported
+}
+
+// Transactions are not supported by this adapter.
+func (self *Source) Transaction() (db.Tx, error) {
+	return nil, db.ErrFeatureNotSupported
+}
+
 // Drops the currently active database. (NOT SUPPORTED)
 func (self *Source) Drop() error {
 	return db.ErrFeatureNotSupported
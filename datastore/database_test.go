@@ -26,14 +26,13 @@
 package datastore
 
 import (
-	"os"
 	"reflect"
 	"strings"
 	"testing"
 	"time"
 
-	"labix.org/v2/mgo"
-	"labix.org/v2/mgo/bson"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
 	"menteslibres.net/gosexy/to"
 	"upper.io/db"
 )
@@ -92,7 +91,7 @@ var testValues = testValuesStruct{
 
 // Enabling outputting some information to stdout, useful for development.
 func TestEnableDebug(t *testing.T) {
-	os.Setenv(db.EnvEnableDebug, "TRUE")
+	db.SetLogger(db.StdLogger)
 }
 
 // Trying to open an empty datasource, it must succeed (mongo).
@@ -683,7 +682,7 @@ func TestDataTypes(t *testing.T) {
 
 // We are going to benchmark the engine, so this is no longed needed.
 func TestDisableDebug(t *testing.T) {
-	os.Setenv(db.EnvEnableDebug, "")
+	db.SetLogger(nil)
 }
 
 // Benchmarking raw mgo queries.
@@ -754,3 +753,51 @@ func BenchmarkAppendStruct(b *testing.B) {
 		}
 	}
 }
+
+// Benchmarking AppendAll() with maps.
+func BenchmarkAppendAllDbItem(b *testing.B) {
+	sess, err := db.Open(wrapperName, settings)
+
+	if err != nil {
+		b.Fatalf(err.Error())
+	}
+
+	defer sess.Close()
+
+	artist, err := sess.Collection("artist")
+	artist.Truncate()
+
+	items := make([]map[string]string, b.N)
+	for i := range items {
+		items[i] = map[string]string{"name": "Leonardo DaVinci"}
+	}
+
+	b.ResetTimer()
+	if _, err = artist.AppendAll(items); err != nil {
+		b.Fatalf(err.Error())
+	}
+}
+
+// Benchmarking AppendAll() with structs.
+func BenchmarkAppendAllStruct(b *testing.B) {
+	sess, err := db.Open(wrapperName, settings)
+
+	if err != nil {
+		b.Fatalf(err.Error())
+	}
+
+	defer sess.Close()
+
+	artist, err := sess.Collection("artist")
+	artist.Truncate()
+
+	items := make([]struct{ Name string }, b.N)
+	for i := range items {
+		items[i].Name = "John Lennon"
+	}
+
+	b.ResetTimer()
+	if _, err = artist.AppendAll(items); err != nil {
+		b.Fatalf(err.Error())
+	}
+}
@@ -26,11 +26,13 @@
 package datastore
 
 import (
+	"context"
 	"errors"
 
-	"labix.org/v2/mgo"
-	"labix.org/v2/mgo/bson"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
 	"upper.io/db"
+	"upper.io/db/util"
 )
 
 type Result struct {
@@ -71,14 +73,59 @@ func (self *Result) Skip(n uint) db.Result {
 // Determines sorting of results according to the provided names. Fields may be
 // prefixed by - (minus) which means descending order, ascending order would be
 // used otherwise.
-func (self *Result) Sort(fields ...string) db.Result {
-	self.queryChunks.Sort = fields
+func (self *Result) Sort(fields ...interface{}) db.Result {
+	// Raw expressions are not supported, they leave the result unsorted.
+	self.queryChunks.Sort, _ = util.FieldNames(fields)
 	return self
 }
 
 // Retrieves only the given fields.
-func (self *Result) Select(fields ...string) db.Result {
-	self.queryChunks.Fields = fields
+func (self *Result) Select(fields ...interface{}) db.Result {
+	// Raw expressions are not supported, they select all the fields.
+	self.queryChunks.Fields, _ = util.FieldNames(fields)
+	return self
+}
+
+// Grouping is not supported by this adapter, results are not grouped.
+func (self *Result) Group(fields ...interface{}) db.Result {
+	return self
+}
+
+// Grouping is not supported by this adapter, results are not filtered.
+func (self *Result) Having(terms ...interface{}) db.Result {
+	return self
+}
+
+// Distinct queries are not supported.
+func (self *Result) Distinct(fields ...interface{}) db.Result {
+	return self
+}
+
+// Distinct queries are not supported.
+func (self *Result) DistinctValues(name string, dst interface{}) error {
+	return db.ErrFeatureNotSupported
+}
+
+// Joins are not supported.
+func (self *Result) Join(table string) db.Joiner {
+	return joiner{self}
+}
+
+// Joins are not supported.
+func (self *Result) LeftJoin(table string) db.Joiner {
+	return joiner{self}
+}
+
+type joiner struct {
+	result *Result
+}
+
+func (self joiner) On(terms ...interface{}) db.Result {
+	return self.result
+}
+
+// Queries are run within the appengine context given in db.Settings.
+func (self *Result) WithContext(ctx context.Context) db.Result {
 	return self
 }
 
@@ -170,6 +217,16 @@ func (self *Result) Update(src interface{}) error {
 	return nil
 }
 
+// Affected counts are not supported by this adapter.
+func (self *Result) RemoveAffected() (uint64, error) {
+	return 0, db.ErrFeatureNotSupported
+}
+
+// Affected counts are not supported by this adapter.
+func (self *Result) UpdateAffected(src interface{}) (uint64, error) {
+	return 0, db.ErrFeatureNotSupported
+}
+
 func (self *Result) query() (*mgo.Query, error) {
 	var err error
 
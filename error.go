@@ -25,6 +25,7 @@ package db
 
 import (
 	"errors"
+	"fmt"
 )
 
 // Application error messages.
@@ -45,4 +46,44 @@ var (
 	ErrMissingConditions       = errors.New(`Missing selector conditions.`)
 	ErrQueryIsPending          = errors.New(`Can't execute this instruction while the result set is still open.`)
 	ErrUnsupportedDestination  = errors.New(`Unsupported destination type.`)
+	ErrQueryCanceled           = errors.New(`Query was canceled.`)
+	ErrQueryTimeout            = errors.New(`Query deadline exceeded.`)
+	ErrUnknownURLScheme        = errors.New(`Unknown URL scheme.`)
+	ErrInvalidURL              = errors.New(`Invalid connection URL.`)
+	ErrUnknownOption           = errors.New(`Unknown option.`)
+	ErrInvalidOptionValue      = errors.New(`Invalid option value.`)
+	ErrUnknownOperator         = errors.New(`Unknown operator, use db.Func to pass it as is.`)
+	ErrInvalidIdentifier       = errors.New(`Invalid identifier.`)
+	ErrInvalidConditionValue   = errors.New(`Invalid value for this condition.`)
+	ErrMissingPrimaryKey       = errors.New(`Collection does not have a primary key.`)
+	ErrUnknownAggregate        = errors.New(`Unknown aggregate function.`)
+	ErrInvalidRelation         = errors.New(`Invalid relation, expecting {collection.column = column}.`)
+	ErrTransactionInProgress   = errors.New(`A transaction block is already in progress.`)
+	ErrNoTransaction           = errors.New(`There is no transaction block in progress.`)
 )
+
+// Returned by Open() when one of the Settings.Options is unknown to the adapter
+// or has a value the adapter can't use. Err is either ErrUnknownOption or
+// ErrInvalidOptionValue.
+type OptionError struct {
+	Key   string
+	Value string
+	Err   error
+}
+
+func (self *OptionError) Error() string {
+	return fmt.Sprintf(`%s (%s=%q)`, self.Err.Error(), self.Key, self.Value)
+}
+
+// Returned when a query uses an operator the adapter doesn't know, a column
+// name the adapter can't quote or a value the operator can't take. Err is
+// either ErrUnknownOperator, ErrInvalidIdentifier or
+// ErrInvalidConditionValue.
+type QueryError struct {
+	Value string
+	Err   error
+}
+
+func (self *QueryError) Error() string {
+	return fmt.Sprintf(`%s (%q)`, self.Err.Error(), self.Value)
+}
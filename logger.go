@@ -0,0 +1,135 @@
+/*
+  Copyright (c) 2012-2014 José Carlos Nieto, https://menteslibres.net/xiam
+
+  Permission is hereby granted, free of charge, to any person obtaining
+  a copy of this software and associated documentation files (the
+  "Software"), to deal in the Software without restriction, including
+  without limitation the rights to use, copy, modify, merge, publish,
+  distribute, sublicense, and/or sell copies of the Software, and to
+  permit persons to whom the Software is furnished to do so, subject to
+  the following conditions:
+
+  The above copyright notice and this permission notice shall be
+  included in all copies or substantial portions of the Software.
+
+  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+  EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+  MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+  NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+  LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+  OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+  WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+
+package db
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Summary of an executed query, passed to a Logger.
+type QueryStatus struct {
+	// Name of the adapter that executed the query.
+	Adapter string
+	// SQL query, or a description of the operation for non-SQL databases.
+	Query string
+	// Arguments of the query.
+	Args []interface{}
+	// Time it took to execute the query.
+	Duration time.Duration
+	// Number of rows affected by the query, -1 if unknown.
+	RowsAffected int64
+	// Error returned by the database, if any.
+	Err error
+}
+
+func (self *QueryStatus) String() string {
+	lines := []string{
+		fmt.Sprintf(`Adapter: %s`, self.Adapter),
+		fmt.Sprintf(`Query: %s`, strings.TrimSpace(self.Query)),
+	}
+	if len(self.Args) > 0 {
+		lines = append(lines, fmt.Sprintf(`Args: %v`, self.Args))
+	}
+	if self.RowsAffected >= 0 {
+		lines = append(lines, fmt.Sprintf(`Rows affected: %d`, self.RowsAffected))
+	}
+	if self.Err != nil {
+		lines = append(lines, fmt.Sprintf(`Error: %v`, self.Err))
+	}
+	lines = append(lines, fmt.Sprintf(`Time taken: %v`, self.Duration))
+	return strings.Join(lines, "\n")
+}
+
+// Receives the status of every query a database executes.
+type Logger interface {
+	Log(*QueryStatus)
+}
+
+type stdLogger struct{}
+
+func (self stdLogger) Log(q *QueryStatus) {
+	log.Printf("\n%s\n", q.String())
+}
+
+// Logger that writes queries with the standard log package.
+var StdLogger Logger = stdLogger{}
+
+var (
+	globalLogger   Logger
+	globalLoggerMu sync.RWMutex
+)
+
+func init() {
+	// Setting UPPERIO_DB_DEBUG enables StdLogger from the start.
+	if os.Getenv(EnvEnableDebug) != "" {
+		SetLogger(StdLogger)
+	}
+}
+
+// Sets the logger of all the databases that don't have their own logger, nil
+// disables logging. Safe to call while queries are running.
+func SetLogger(logger Logger) {
+	globalLoggerMu.Lock()
+	globalLogger = logger
+	globalLoggerMu.Unlock()
+}
+
+// Returns the logger set with SetLogger(), or nil.
+func GetLogger() Logger {
+	globalLoggerMu.RLock()
+	defer globalLoggerMu.RUnlock()
+	return globalLogger
+}
+
+// Reports queries that take longer than Threshold to Handler, see
+// Database.SetSlowQueryReport().
+type SlowQueryReport struct {
+	// Minimum duration of a query to be considered slow.
+	Threshold time.Duration
+	// Captures the output of EXPLAIN for slow queries (postgresql and mysql
+	// only).
+	Explain bool
+	// Receives the slow queries. It's called synchronously, after the query
+	// ends.
+	Handler func(*SlowQuery)
+}
+
+// A query that exceeded the slow query threshold.
+type SlowQuery struct {
+	QueryStatus
+	// Output of EXPLAIN for the query, if requested and supported.
+	Explain string
+	// Error returned while running EXPLAIN, if any.
+	ExplainErr error
+}
+
+// Returns true if a query that took the given time must be reported.
+func (self *SlowQueryReport) IsSlow(d time.Duration) bool {
+	return self != nil && self.Handler != nil && d >= self.Threshold
+}
@@ -25,6 +25,12 @@
 // different databases using a reduced instruction set.
 package db
 
+import (
+	"context"
+	"strings"
+	"time"
+)
+
 /*
 	The db.Cond{} expression is used to define conditions in a query, it can be
 	viewed as a replacement for the SQL "WHERE" clause.
@@ -36,6 +42,34 @@ package db
 	db.Cond { "age >=": 18 }		// Where age is greater than or equal to 18.
 
 	db.Cond { "age $lt": 18 }		// Where age is lower than 18 (MongoDB specific).
+
+	The following operators work the same on every adapter:
+
+	db.Cond { "age IN": []int{18, 19} }			// Where age is either 18 or 19.
+
+	db.Cond { "age NOT IN": []int{18, 19} }	// Where age is neither 18 nor 19.
+
+	db.Cond { "age BETWEEN": []int{18, 30} }	// Where age is between 18 and 30, inclusive.
+
+	db.Cond { "name LIKE": "Max%" }				// Where name starts with "Max".
+
+	db.Cond { "name ILIKE": "max%" }			// Same as LIKE, but case insensitive.
+
+	db.Cond { "name REGEXP": "^Ma?x$" }		// Where name matches a regular expression.
+
+	db.Cond { "name IS NULL": true }			// Where name is NULL, the value is ignored.
+
+	LIKE, ILIKE, REGEXP, IN, BETWEEN and IS NULL can be negated with NOT, as in
+	"name NOT LIKE" or "name IS NOT NULL". A slice value without an operator
+	means IN and a nil value means IS NULL. In LIKE patterns "%" matches any
+	sequence of characters, "_" matches a single character and "\" escapes the
+	next character.
+
+	SQL adapters take a Result of the same database as a subquery:
+
+	db.Cond { "user_id": users.Find(db.Cond{"active": true}).Select("id") }
+
+	A subquery without an operator means IN and one with != means NOT IN.
 */
 type Cond map[string]interface{}
 
@@ -47,9 +81,28 @@ type Func struct {
 	Args interface{}
 }
 
+/*
+	The db.Raw expression is a fragment of SQL that is written as is, ? marks
+	where each of the Args go. It can be used as a condition in Find(), as a
+	value in db.Cond{} or Update() maps and as a field in Select() or Sort().
+
+	Examples:
+
+	db.Raw{"lower(email) = ?", []interface{}{"max@example.com"}}
+
+	db.Cond{"updated_at <": db.Raw{Value: "NOW()"}}
+
+	Raw expressions are not supported by MongoDB.
+*/
+type Raw struct {
+	Value string
+	Args  []interface{}
+}
+
 /*
 	The db.And() expression is used to glue two or more expressions under logical
-	conjunction, it accepts db.Cond{}, db.Or() and other db.And() expressions.
+	conjunction, it accepts db.Cond{}, db.Or(), db.Not() and other db.And()
+	expressions.
 
 	Examples:
 
@@ -70,7 +123,8 @@ type And []interface{}
 
 /*
 	The db.Or() expression is used to glue two or more expressions under logical
-	disjunction, it accepts db.Cond{}, db.And() and other db.Or() expressions.
+	disjunction, it accepts db.Cond{}, db.And(), db.Not() and other db.Or()
+	expressions.
 
 	Example:
 
@@ -81,6 +135,111 @@ type And []interface{}
 */
 type Or []interface{}
 
+/*
+	The db.Not() expression is used to negate expressions, it accepts
+	db.Cond{}, db.And(), db.Or() and other db.Not() expressions. Two or more
+	expressions are joined by logical conjunction before being negated.
+
+	Example:
+
+	db.Not (
+		db.Or (
+			db.Cond { "year": 2012 },
+			db.Cond { "year": 1987 },
+		),
+	)
+*/
+type Not []interface{}
+
+/*
+	The db.Aggregate expression is an aggregate function over a field, it can be
+	used as a field in Select(), next to the fields given to Group(). Results
+	are named after the function and the field, as in "sum_total", unless
+	another name is given with As(). Use db.Sum(), db.Avg(), db.Min(), db.Max()
+	or db.CountOf() to create one.
+
+	Example:
+
+	res = col.Find().Group("category").Select(
+		"category",
+		db.Sum("total").As("total"),
+		db.CountOf("*"),
+	)
+*/
+type Aggregate struct {
+	// Aggregate function: COUNT, SUM, AVG, MIN or MAX.
+	Func string
+	// Field the function is applied to, "*" counts all the items.
+	Field string
+	// Name of the result, leave blank for the default name.
+	Name string
+}
+
+// Returns a copy of the aggregate with the given result name.
+func (self Aggregate) As(name string) Aggregate {
+	self.Name = name
+	return self
+}
+
+// Returns the name of the result of the aggregate.
+func (self Aggregate) Alias() string {
+	if self.Name != "" {
+		return self.Name
+	}
+	fn := strings.ToLower(self.Func)
+	if self.Field == `*` {
+		return fn
+	}
+	return fn + `_` + strings.Replace(self.Field, `.`, `_`, -1)
+}
+
+// Returns the sum of the values of a field.
+func Sum(field string) Aggregate {
+	return Aggregate{Func: `SUM`, Field: field}
+}
+
+// Returns the average of the values of a field.
+func Avg(field string) Aggregate {
+	return Aggregate{Func: `AVG`, Field: field}
+}
+
+// Returns the minimum value of a field.
+func Min(field string) Aggregate {
+	return Aggregate{Func: `MIN`, Field: field}
+}
+
+// Returns the maximum value of a field.
+func Max(field string) Aggregate {
+	return Aggregate{Func: `MAX`, Field: field}
+}
+
+// Returns the number of items that have a value in the given field, "*"
+// counts all the items.
+func CountOf(field string) Aggregate {
+	return Aggregate{Func: `COUNT`, Field: field}
+}
+
+/*
+	The db.Key expression matches the item that has the given primary key, it
+	holds one value per column of the key, in the order returned by
+	Collection.PrimaryKey(). Use db.ID() to create one.
+*/
+type Key []interface{}
+
+/*
+	Returns a db.Key expression for the given primary key values, composite keys
+	take one value per column.
+
+	Examples:
+
+	col.Find(db.ID(12))
+
+	col.Find(db.ID("es", "hello"))
+*/
+func ID(values ...interface{}) Key {
+	return Key(values)
+}
+
 // Connection and authentication data.
 type Settings struct {
 	// Database server hostname or IP. Leave blank if using unix sockets.
@@ -99,6 +258,27 @@ type Settings struct {
 	Charset string
 	// Context. Leave blank if not using appengine datastore
 	Context interface{}
+	// Adapter specific options, such as the query parameters of a connection
+	// URL (see ParseURL).
+	Options map[string]string
+	// Maximum number of open connections. Leave blank for no limit.
+	MaxOpenConns int
+	// Maximum number of idle connections. Leave blank to use the driver's
+	// default.
+	MaxIdleConns int
+	// Maximum amount of time a connection may be reused. Leave blank to reuse
+	// connections forever.
+	ConnMaxLifetime time.Duration
+}
+
+// Connection pool statistics.
+type Stats struct {
+	// Number of established connections, both in use and idle.
+	OpenConnections int
+	// Number of connections currently in use.
+	InUse int
+	// Number of idle connections.
+	Idle int
 }
 
 // Database methods.
@@ -110,10 +290,21 @@ type Database interface {
 	Open() error
 
 	// Clones the current database session.
-	// Clone() (Database, error)
+	Clone() (Database, error)
 
 	// Returns error if the database server cannot be reached.
-	// Ping() error
+	Ping() error
+
+	// Returns statistics about the connection pool.
+	Stats() Stats
+
+	// Sets the logger that receives the queries of this database, overriding
+	// the one given to db.SetLogger(). Pass nil to fall back to the latter.
+	SetLogger(Logger)
+
+	// Reports queries of this database that are slower than the given
+	// threshold to a handler. Pass nil to stop reporting.
+	SetSlowQueryReport(*SlowQueryReport)
 
 	// Closes the currently active connection to the database.
 	Close() error
@@ -138,24 +329,127 @@ type Database interface {
 	Name() string
 
 	// Starts a transaction block (if the database supports transactions).
+	//
+	// Deprecated: Use Transaction() instead.
 	Begin() error
 
 	// Ends a transaction block (if the database supports transactions).
+	//
+	// Deprecated: Use Transaction() instead.
 	End() error
+
+	// Returns a copy of the database that runs all its queries within the given
+	// context. Queries that are interrupted by the context return
+	// db.ErrQueryCanceled or db.ErrQueryTimeout.
+	WithContext(context.Context) Database
+
+	// Executes a raw query and returns an iterator that maps the returned rows
+	// into maps or structs, just like db.Result does (SQL databases only).
+	// Placeholders are written as "?" regardless of the database.
+	Query(string, ...interface{}) (Iterator, error)
+
+	// Executes a raw statement that does not return rows (SQL databases only).
+	Exec(string, ...interface{}) (ExecResult, error)
+
+	// Starts a transaction and returns a db.Tx. Collections and results that
+	// are obtained from the returned db.Tx are bound to the transaction.
+	// Calling Transaction() on a db.Tx starts a nested transaction (if the
+	// database supports savepoints).
+	Transaction() (Tx, error)
+}
+
+// Transaction methods.
+type Tx interface {
+	Database
+
+	// Discards all the instructions on the current transaction.
+	Rollback() error
+
+	// Commits the current transaction.
+	Commit() error
+}
+
+/*
+	Joiner methods, see Result.Join(). Results can be decoded into structs that
+	inline a struct per collection under the name of the collection:
+
+	type OrderCustomer struct {
+		Order    `db:"orders,inline"`
+		Customer `db:"c,inline"`
+	}
+
+	col.Find().Join("customers c").On("orders.customer_id = c.id").All(&items)
+*/
+type Joiner interface {
+	// Sets the conditions rows are joined on and returns the result set,
+	// strings are written as they are and other conditions are the same as the
+	// ones of Find().
+	On(...interface{}) Result
+}
+
+// Iterator methods. A db.Result can also be used as a db.Iterator.
+type Iterator interface {
+	// Fetches the next result and dumps it into the given pointer to struct or
+	// pointer to map. You must manually call Close() after finishing using
+	// Next().
+	Next(interface{}) error
+
+	// Fetches the first result and dumps it into the given pointer to struct or
+	// pointer to map. Then it calls Close() to free the iterator.
+	One(interface{}) error
+
+	// Fetches all results and dumps them into the given pointer to slice of maps
+	// or structs. Then it calls Close() to free the iterator.
+	All(interface{}) error
+
+	// Closes the iterator.
+	Close() error
+}
+
+// Summary of an executed statement, sql.Result satisfies this interface.
+type ExecResult interface {
+	// Returns the ID generated by the database after an insertion.
+	LastInsertId() (int64, error)
+
+	// Returns the number of rows affected by the statement.
+	RowsAffected() (int64, error)
 }
 
 // Collection methods.
 type Collection interface {
 
 	// Inserts a new item into the collection. Can work with maps or structs.
+	// Given a pointer, the item is replaced by the row as it was stored,
+	// including the values the database generated (MongoDB sets the _id
+	// only).
 	Append(interface{}) (interface{}, error)
 
+	// Inserts all the items of a slice of maps or structs into the collection
+	// and returns their IDs, in the same order. IDs are nil if the database
+	// can't tell them.
+	AppendAll(interface{}) ([]interface{}, error)
+
+	// Inserts an item (map or struct), or updates the items that match the
+	// given conditions if there are any. Conditions must be equalities on the
+	// fields that identify an item, SQL databases require a unique constraint
+	// on them.
+	Upsert(Cond, interface{}) error
+
 	// Returns true if the collection exists.
 	Exists() bool
 
 	// Creates a filter with the given conditions and returns a result set.
 	Find(...interface{}) Result
 
+	// Fetches the item with the given primary key value, or db.Key, and dumps
+	// it into the given pointer to struct or pointer to map. Returns
+	// db.ErrNoMoreRows if there's no such item.
+	Get(interface{}, interface{}) error
+
+	// Returns the names of the columns of the primary key, in order. The key is
+	// empty if the collection does not have one.
+	PrimaryKey() []string
+
 	// Truncates the collection.
 	Truncate() error
 
@@ -173,11 +467,40 @@ type Result interface {
 
 	// Receives fields that define the order in which elements will be returned in
 	// a query, field names may be prefixed with a minus sign (-) indicating
-	// descending order; ascending order would be used otherwise.
-	Sort(...string) Result
+	// descending order; ascending order would be used otherwise. Fields are
+	// either strings or db.Raw expressions.
+	Sort(...interface{}) Result
+
+	// Defines specific fields to be returned on results on this result set,
+	// fields are either strings, db.Raw or db.Aggregate expressions.
+	Select(...interface{}) Result
+
+	// Groups the results by the given fields, either strings or db.Raw
+	// expressions. Selected fields must be either grouped or aggregates.
+	Group(...interface{}) Result
+
+	// Filters the groups of the result set by the given conditions, which take
+	// the same expressions as Find(). Conditions may refer to aggregates by
+	// their names.
+	Having(...interface{}) Result
+
+	// Retrieves only distinct rows of the given fields, or of the fields given
+	// to Select() if none are given.
+	Distinct(...interface{}) Result
 
-	// Defines specific fields to be returned on results on this result set.
-	Select(...string) Result
+	// Dumps the distinct values of the given field into a pointer to a slice of
+	// any type, like *[]string.
+	DistinctValues(string, interface{}) error
+
+	// Joins the rows of another collection, whose name may be followed by an
+	// alias ("customers c"), leaving out rows without a match. Results have
+	// the fields of every joined collection, named after the collection (or
+	// its alias) and the field, as in "c.name", unless others are selected
+	// (SQL databases only).
+	Join(string) Joiner
+
+	// Like Join(), but keeps rows without a match (SQL databases only).
+	LeftJoin(string) Joiner
 
 	// Removes all items within the result set.
 	Remove() error
@@ -185,6 +508,14 @@ type Result interface {
 	// Updates all items within the result set. Receives an struct or an interface{}.
 	Update(interface{}) error
 
+	// Removes all items within the result set and returns the number of items
+	// that were removed.
+	RemoveAffected() (uint64, error)
+
+	// Updates all items within the result set and returns the number of items
+	// that matched the result set, whether their values changed or not.
+	UpdateAffected(interface{}) (uint64, error)
+
 	// Counts all items within the result set.
 	Count() (uint64, error)
 
@@ -195,18 +526,41 @@ type Result interface {
 
 	// Fetches the first result within the result set and dumps it into the given
 	// pointer to struct or pointer to map. Then it calls Close() to free the
-	// result set.
+	// result set. Relations of the struct are fetched too, see All().
 	One(interface{}) error
 
 	// Fetches all results within the result set and dumps them into the given
 	// pointer to slice of maps or structs. Then it calls Close() to free the
 	// result set.
+	//
+	// Struct fields tagged with a relation are filled with the items of another
+	// collection, using one query per relation for all the results:
+	//
+	//	type Book struct {
+	//		ID       int     `db:"id"`
+	//		AuthorID int     `db:"author_id"`
+	//		Author   *Author `db:"author,{authors.id = author_id}" bson:"-"`
+	//	}
+	//
+	//	type Author struct {
+	//		ID    int    `db:"id"`
+	//		Books []Book `db:"books,{books.author_id = id}" bson:"-"`
+	//	}
+	//
+	// Slice fields take all the related items, struct and pointer fields take
+	// the first one. Relations pointing back to a struct being fetched, like
+	// Book.Author when fetching authors, are left empty. MongoDB encodes
+	// structs with their bson tags, so relations need bson:"-" there.
 	All(interface{}) error
 
+	// Runs the queries of this result set within the given context.
+	WithContext(context.Context) Result
+
 	// Closes the result set.
 	Close() error
 }
 
 var (
+	// Environment variable that enables StdLogger when the program starts.
 	EnvEnableDebug = `UPPERIO_DB_DEBUG`
 )
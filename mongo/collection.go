@@ -24,10 +24,15 @@
 package mongo
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
-	"labix.org/v2/mgo"
-	"labix.org/v2/mgo/bson"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"reflect"
+	"sort"
 	"strings"
+	"time"
 	"upper.io/db"
 	"upper.io/db/util"
 )
@@ -46,6 +51,42 @@ type chunks struct {
 	Offset     int
 	Sort       []string
 	Conditions interface{}
+	// Grouped fields, aggregates and conditions on groups, which make the
+	// query run as an aggregation pipeline.
+	Group      []string
+	Aggregates []db.Aggregate
+	Having     interface{}
+	// Distinct documents are grouped by their selected fields.
+	Distinct bool
+	// Error found while compiling conditions, returned when the query runs.
+	Err error
+}
+
+// Operators that can be used in conditions, standard operators are mapped to
+// mongo's.
+var operators = map[string]string{
+	`!=`:         `$ne`,
+	`<>`:         `$ne`,
+	`IS NOT`:     `$ne`,
+	`>`:          `$gt`,
+	`<`:          `$lt`,
+	`<=`:         `$lte`,
+	`>=`:         `$gte`,
+	`$eq`:        `$eq`,
+	`$ne`:        `$ne`,
+	`$gt`:        `$gt`,
+	`$gte`:       `$gte`,
+	`$lt`:        `$lt`,
+	`$lte`:       `$lte`,
+	`$in`:        `$in`,
+	`$nin`:       `$nin`,
+	`$all`:       `$all`,
+	`$exists`:    `$exists`,
+	`$regex`:     `$regex`,
+	`$size`:      `$size`,
+	`$type`:      `$type`,
+	`$mod`:       `$mod`,
+	`$elemMatch`: `$elemMatch`,
 }
 
 func (self *Collection) Find(terms ...interface{}) db.Result {
@@ -57,135 +98,293 @@ func (self *Collection) Find(terms ...interface{}) db.Result {
 		queryChunks.Fields = []string{"*"}
 	}
 
-	queryChunks.Conditions = self.compileQuery(terms...)
-
-	if debugEnabled() == true {
-		debugLogQuery(queryChunks)
-	}
+	queryChunks.Conditions, queryChunks.Err = self.compileQuery(terms...)
 
 	// Actually executing query.
 	result := &Result{
-		self,
-		queryChunks,
-		nil,
+		c:           self,
+		queryChunks: queryChunks,
 	}
 
 	return result
 }
 
+// Fetches the document with the given _id value or db.Key.
+func (self *Collection) Get(id interface{}, dst interface{}) error {
+	key, ok := id.(db.Key)
+	if ok == false {
+		key = db.ID(id)
+	}
+	return self.Find(key).One(dst)
+}
+
+// Returns the primary key of the collection, which is always _id.
+func (self *Collection) PrimaryKey() []string {
+	return []string{`_id`}
+}
+
+// Returns a handle of the collection that honors the deadline of the given
+// context, the returned function must be called to release the handle.
+func (self *Collection) withContext(ctx context.Context) (*mgo.Collection, func(), error) {
+	if err := ctx.Err(); err != nil {
+		return nil, nil, util.ContextError(ctx, err)
+	}
+
+	deadline, ok := ctx.Deadline()
+
+	if ok == false {
+		return self.collection, func() {}, nil
+	}
+
+	session := self.collection.Database.Session.Copy()
+	session.SetSocketTimeout(deadline.Sub(time.Now()))
+
+	return self.collection.With(session), session.Close, nil
+}
+
+// Returns a mongo shell-like representation of an operation, for logging.
+func (self *Collection) describe(op string, args ...interface{}) string {
+	params := make([]string, len(args))
+	for i := range args {
+		if buf, err := json.Marshal(args[i]); err == nil {
+			params[i] = string(buf)
+		} else {
+			params[i] = fmt.Sprintf(`%v`, args[i])
+		}
+	}
+	return fmt.Sprintf(`db.%s.%s(%s)`, self.name, op, strings.Join(params, `, `))
+}
+
 // Transforms conditions into something *mgo.Session can understand.
-func compileStatement(cond db.Cond) bson.M {
-	conds := bson.M{}
+func compileStatement(cond db.Cond) (interface{}, error) {
+	keys := make([]string, 0, len(cond))
+
+	// Sorting keys, so the same conditions always produce the same query.
+	for key := range cond {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	conds := make([]interface{}, 0, len(keys))
+	fields := bson.M{}
+	repeated := false
 
 	// Walking over conditions
-	for field, value := range cond {
+	for _, key := range keys {
 		// Removing leading or trailing spaces.
-		field = strings.TrimSpace(field)
+		field := strings.TrimSpace(key)
 
 		chunks := strings.SplitN(field, ` `, 2)
 
-		var op string
-
-		if len(chunks) > 1 {
-			switch chunks[1] {
-			case `>`:
-				op = `$gt`
-			case `<`:
-				op = `$lt`
-			case `<=`:
-				op = `$lte`
-			case `>=`:
-				op = `$gte`
-			default:
-				op = chunks[1]
-			}
-		}
+		var compiled interface{}
 
-		switch value := value.(type) {
+		switch value := cond[key].(type) {
 		case db.Func:
-			conds[chunks[0]] = bson.M{value.Name: value.Args}
+			compiled = bson.M{value.Name: value.Args}
+		case db.Raw, db.Result:
+			// Raw expressions and subqueries are SQL only.
+			return nil, db.ErrFeatureNotSupported
 		default:
-			if op == "" {
-				conds[chunks[0]] = value
-			} else {
-				conds[chunks[0]] = bson.M{op: value}
+			op := `=`
+			if len(chunks) > 1 {
+				op = strings.TrimSpace(chunks[1])
+			}
+			var err error
+			if compiled, err = compare(op, value); err != nil {
+				return nil, &db.QueryError{Value: field, Err: err}
 			}
 		}
 
+		if _, ok := fields[chunks[0]]; ok {
+			repeated = true
+		}
+
+		fields[chunks[0]] = compiled
+		conds = append(conds, bson.M{chunks[0]: compiled})
 	}
 
-	return conds
+	switch {
+	case len(conds) == 0:
+		return nil, nil
+	case repeated:
+		// A field can't appear twice in a document, conditions on the same field
+		// ("age >" and "age <") must be joined by $and.
+		return bson.M{`$and`: conds}, nil
+	}
+
+	return fields, nil
 }
 
-// Compiles terms into something *mgo.Session can understand.
-func (self *Collection) compileConditions(term interface{}) interface{} {
+// Returns true if value is a slice, a []byte is a single value.
+func isSlice(value interface{}) bool {
+	if value == nil {
+		return false
+	}
+	if _, ok := value.([]byte); ok {
+		return false
+	}
+	kind := reflect.TypeOf(value).Kind()
+	return kind == reflect.Slice || kind == reflect.Array
+}
 
-	switch t := term.(type) {
-	case []interface{}:
-		values := []interface{}{}
-		for i, _ := range t {
-			value := self.compileConditions(t[i])
-			if value != nil {
-				values = append(values, value)
-			}
+// Compiles the portable operators of db.Cond (IN, BETWEEN, LIKE...) and
+// mongo's own operators into the value of a field condition.
+func compare(op string, value interface{}) (interface{}, error) {
+	if strings.HasPrefix(op, `$`) == false {
+		op = strings.Join(strings.Fields(strings.ToUpper(op)), ` `)
+	}
+
+	// A slice value without an explicit operator.
+	switch op {
+	case `=`, `==`, `IS`:
+		if isSlice(value) {
+			op = `IN`
 		}
-		if len(values) > 0 {
-			return values
+	case `!=`, `<>`, `IS NOT`:
+		if isSlice(value) {
+			op = `NOT IN`
 		}
-	case db.Or:
-		values := []interface{}{}
-		for i, _ := range t {
-			values = append(values, self.compileConditions(t[i]))
+	}
+
+	switch op {
+	case `=`, `==`, `IS`, `IS NULL`:
+		if op == `IS NULL` {
+			value = nil
+		}
+		// A nil value matches fields that are null or missing.
+		return value, nil
+	case `IS NOT NULL`:
+		return bson.M{`$ne`: nil}, nil
+	case `IN`, `NOT IN`:
+		if isSlice(value) == false {
+			value = []interface{}{value}
+		}
+		if op == `IN` {
+			return bson.M{`$in`: value}, nil
+		}
+		return bson.M{`$nin`: value}, nil
+	case `BETWEEN`, `NOT BETWEEN`:
+		if isSlice(value) == false || reflect.ValueOf(value).Len() != 2 {
+			return nil, db.ErrInvalidConditionValue
+		}
+		v := reflect.ValueOf(value)
+		between := bson.M{`$gte`: v.Index(0).Interface(), `$lte`: v.Index(1).Interface()}
+		if op == `BETWEEN` {
+			return between, nil
+		}
+		return bson.M{`$not`: between}, nil
+	case `LIKE`, `ILIKE`, `REGEXP`, `NOT LIKE`, `NOT ILIKE`, `NOT REGEXP`:
+		pattern, ok := value.(string)
+		if ok == false {
+			return nil, db.ErrInvalidConditionValue
+		}
+		regex := bson.RegEx{Pattern: pattern}
+		switch strings.TrimPrefix(op, `NOT `) {
+		case `LIKE`:
+			regex.Pattern = util.LikeToRegexp(pattern)
+		case `ILIKE`:
+			regex.Pattern = util.LikeToRegexp(pattern)
+			regex.Options = `i`
 		}
-		condition := bson.M{`$or`: values}
-		return condition
+		if strings.HasPrefix(op, `NOT `) {
+			return bson.M{`$not`: regex}, nil
+		}
+		return bson.M{`$regex`: regex.Pattern, `$options`: regex.Options}, nil
+	}
+
+	if mop, ok := operators[op]; ok {
+		return bson.M{mop: value}, nil
+	}
+
+	return nil, db.ErrUnknownOperator
+}
+
+// Compiles terms into something *mgo.Session can understand, returns nil if
+// there are no conditions.
+func (self *Collection) compileConditions(term interface{}) (interface{}, error) {
+
+	switch t := term.(type) {
+	case []interface{}:
+		return self.compileLogical(`$and`, t)
+	case db.Or:
+		return self.compileLogical(`$or`, t)
 	case db.And:
-		values := []interface{}{}
-		for i, _ := range t {
-			values = append(values, self.compileConditions(t[i]))
+		return self.compileLogical(`$and`, t)
+	case db.Not:
+		value, err := self.compileLogical(`$and`, t)
+		if err != nil || value == nil {
+			return nil, err
 		}
-		condition := bson.M{`$and`: values}
-		return condition
+		// $not only applies to a single field.
+		return bson.M{`$nor`: []interface{}{value}}, nil
 	case db.Cond:
 		return compileStatement(t)
+	case db.Key:
+		// Documents are keyed by _id alone.
+		if len(t) != 1 {
+			return nil, &db.QueryError{Value: `_id`, Err: db.ErrInvalidConditionValue}
+		}
+		return compileStatement(db.Cond{`_id`: t[0]})
+	case db.Raw:
+		return nil, db.ErrFeatureNotSupported
 	}
-	return nil
+	return nil, nil
 }
 
-// Compiles terms into something that *mgo.Session can understand.
-func (self *Collection) compileQuery(terms ...interface{}) interface{} {
-	var query interface{}
+// Joins the compiled terms with the given logical operator, a single term is
+// returned as is.
+func (self *Collection) compileLogical(op string, terms []interface{}) (interface{}, error) {
+	values := []interface{}{}
+
+	for i := range terms {
+		value, err := self.compileConditions(terms[i])
+		if err != nil {
+			return nil, err
+		}
+		if value != nil {
+			values = append(values, value)
+		}
+	}
 
-	compiled := self.compileConditions(terms)
+	switch len(values) {
+	case 0:
+		return nil, nil
+	case 1:
+		return values[0], nil
+	}
 
-	if compiled != nil {
-		conditions := compiled.([]interface{})
-		if len(conditions) == 1 {
-			query = conditions[0]
-		} else {
-			// this should be correct.
-			// query = map[string]interface{}{"$and": conditions}
-
-			// trying to workaround https://jira.mongodb.org/browse/SERVER-4572
-			mapped := map[string]interface{}{}
-			for _, v := range conditions {
-				for kk, _ := range v.(map[string]interface{}) {
-					mapped[kk] = v.(map[string]interface{})[kk]
-				}
-			}
+	return bson.M{op: values}, nil
+}
 
-			query = mapped
-		}
-	} else {
-		query = map[string]interface{}{}
+// Compiles terms into something that *mgo.Session can understand.
+func (self *Collection) compileQuery(terms ...interface{}) (interface{}, error) {
+	query, err := self.compileConditions(terms)
+	if err != nil {
+		return nil, err
 	}
 
-	return query
+	if query == nil {
+		return map[string]interface{}{}, nil
+	}
+
+	return query, nil
 }
 
 // Deletes all the rows within the collection.
 func (self *Collection) Truncate() error {
-	err := self.collection.DropCollection()
+	ctx := self.parent.context()
+
+	col, release, err := self.withContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	start := time.Now()
+
+	err = util.ContextError(ctx, col.DropCollection())
+	self.parent.logQuery(self.describe(`drop`), start, -1, err)
 
 	if err != nil {
 		return err
@@ -199,18 +398,36 @@ func (self *Collection) Append(item interface{}) (interface{}, error) {
 	var err error
 	var id bson.ObjectId
 
+	ctx := self.parent.context()
+
+	col, release, err := self.withContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
 	id = bson.NewObjectId()
 
 	// Allocating a new ID.
-	if err = self.collection.Insert(bson.M{"_id": id}); err != nil {
+	start := time.Now()
+	err = util.ContextError(ctx, col.Insert(bson.M{"_id": id}))
+	self.parent.logQuery(self.describe(`insert`, bson.M{"_id": id}), start, 1, err)
+
+	if err != nil {
 		return nil, err
 	}
 
 	// Now append data the user wants to append.
-	if err = self.collection.Update(bson.M{"_id": id}, item); err != nil {
+	start = time.Now()
+	err = util.ContextError(ctx, col.Update(bson.M{"_id": id}, item))
+	self.parent.logQuery(self.describe(`update`, bson.M{"_id": id}, item), start, 1, err)
+
+	if err != nil {
 		return nil, err
 	}
 
+	setID(item, id)
+
 	return id, nil
 
 	/*
@@ -229,6 +446,143 @@ func (self *Collection) Append(item interface{}) (interface{}, error) {
 	*/
 }
 
+// Sets the _id of the struct or map a pointer item points to, unless it has
+// one already.
+func setID(item interface{}, id bson.ObjectId) {
+	item_v := reflect.ValueOf(item)
+
+	if item_v.Kind() != reflect.Ptr || item_v.IsNil() {
+		return
+	}
+
+	item_v = item_v.Elem()
+	id_v := reflect.ValueOf(id)
+
+	switch item_v.Kind() {
+	case reflect.Struct:
+		item_t := item_v.Type()
+		for i := 0; i < item_t.NumField(); i++ {
+			name := strings.SplitN(item_t.Field(i).Tag.Get(`bson`), `,`, 2)[0]
+			if name != `_id` {
+				continue
+			}
+			field := item_v.Field(i)
+			if field.CanSet() && id_v.Type().AssignableTo(field.Type()) && reflect.DeepEqual(field.Interface(), reflect.Zero(field.Type()).Interface()) {
+				field.Set(id_v)
+			}
+			return
+		}
+	case reflect.Map:
+		if item_v.IsNil() || item_v.Type().Key().Kind() != reflect.String || id_v.Type().AssignableTo(item_v.Type().Elem()) == false {
+			return
+		}
+		key := reflect.ValueOf(`_id`).Convert(item_v.Type().Key())
+		if item_v.MapIndex(key).IsValid() == false {
+			item_v.SetMapIndex(key, id_v)
+		}
+	}
+}
+
+// Appends the items of a slice of maps or structs into the collection with a
+// single insert, items that lack an _id get a new one.
+func (self *Collection) AppendAll(items interface{}) ([]interface{}, error) {
+	items_v := reflect.ValueOf(items)
+
+	if items_v.Kind() == reflect.Ptr {
+		items_v = items_v.Elem()
+	}
+
+	if items_v.Kind() != reflect.Slice {
+		return nil, db.ErrExpectingSliceMapStruct
+	}
+
+	docs := make([]interface{}, items_v.Len())
+	ids := make([]interface{}, items_v.Len())
+
+	for i := range docs {
+		buf, err := bson.Marshal(items_v.Index(i).Interface())
+		if err != nil {
+			return nil, err
+		}
+
+		doc := bson.M{}
+		if err = bson.Unmarshal(buf, doc); err != nil {
+			return nil, err
+		}
+
+		if _, ok := doc["_id"]; ok == false {
+			doc["_id"] = bson.NewObjectId()
+		}
+
+		docs[i] = doc
+		ids[i] = doc["_id"]
+	}
+
+	if len(docs) == 0 {
+		return ids, nil
+	}
+
+	ctx := self.parent.context()
+
+	col, release, err := self.withContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	start := time.Now()
+	err = util.ContextError(ctx, col.Insert(docs...))
+	self.parent.logQuery(self.describe(`insert`, docs), start, int64(len(docs)), err)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return ids, nil
+}
+
+// Inserts an item, or updates the document that matches the conditions if
+// there's one already.
+func (self *Collection) Upsert(cond db.Cond, item interface{}) error {
+	if len(cond) == 0 {
+		return db.ErrMissingConditions
+	}
+
+	query, err := compileStatement(cond)
+	if err != nil {
+		return err
+	}
+
+	ctx := self.parent.context()
+
+	col, release, err := self.withContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	var info *mgo.ChangeInfo
+	var affected int64
+
+	change := bson.M{"$set": item}
+
+	start := time.Now()
+
+	info, err = col.Upsert(query, change)
+	err = util.ContextError(ctx, err)
+
+	if info != nil {
+		affected = int64(info.Updated)
+		if info.UpsertedId != nil {
+			affected++
+		}
+	}
+
+	self.parent.logQuery(self.describe(`update`, query, change, bson.M{`upsert`: true}), start, affected, err)
+
+	return err
+}
+
 // Returns true if the collection exists.
 func (self *Collection) Exists() bool {
 	query := self.parent.database.C(`system.namespaces`).Find(map[string]string{`name`: fmt.Sprintf(`%s.%s`, self.parent.Name(), self.Name())})
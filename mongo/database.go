@@ -24,40 +24,102 @@
 package mongo
 
 import (
-	"fmt"
-	"labix.org/v2/mgo"
-	"log"
+	"context"
+	"gopkg.in/mgo.v2"
+	"net"
 	"net/url"
-	"os"
+	"strconv"
 	"strings"
 	"time"
 	"upper.io/db"
+	"upper.io/db/util"
 )
 
 const driverName = `mongo`
 
+// Default connection timeout, may be overridden by the "connectTimeoutMS"
+// option.
 var connTimeout = time.Second * 5
 
-type Source struct {
-	name     string
-	config   db.Settings
-	session  *mgo.Session
-	database *mgo.Database
+// Options that can be given in db.Settings.Options, named after the options
+// of MongoDB connection strings.
+var options = []string{
+	`connectTimeoutMS`,
+	`socketTimeoutMS`,
+	`replicaSet`,
+	`readPreference`,
+}
+
+var readPreferences = map[string]mgo.Mode{
+	`primary`:            mgo.Primary,
+	`primaryPreferred`:   mgo.PrimaryPreferred,
+	`secondary`:          mgo.Secondary,
+	`secondaryPreferred`: mgo.SecondaryPreferred,
+	`nearest`:            mgo.Nearest,
 }
 
-func debugEnabled() bool {
-	if os.Getenv(db.EnvEnableDebug) != "" {
-		return true
+// Parses a number of milliseconds given as option value.
+func parseMilliseconds(key string, value string) (time.Duration, error) {
+	ms, err := strconv.Atoi(value)
+	if err != nil || ms < 0 {
+		return 0, &db.OptionError{Key: key, Value: value, Err: db.ErrInvalidOptionValue}
 	}
-	return false
+	return time.Duration(ms) * time.Millisecond, nil
+}
+
+type Source struct {
+	name        string
+	config      db.Settings
+	session     *mgo.Session
+	database    *mgo.Database
+	ctx         context.Context
+	logger      db.Logger
+	slowQueries *db.SlowQueryReport
+	// Sources returned by WithContext() share the session of their parent.
+	shared bool
 }
 
 func init() {
+	// Socket statistics are required by Stats().
+	mgo.SetStats(true)
 	db.Register(driverName, &Source{})
 }
 
-func debugLogQuery(c *chunks) {
-	log.Printf("Fields: %v\nLimit: %v\nOffset: %v\nSort: %v\nConditions: %v\n", c.Fields, c.Limit, c.Offset, c.Sort, c.Conditions)
+// Sends the status of an operation to the logger of this source, if any, and
+// to the slow query handler if the operation was slow.
+func (self *Source) logQuery(query string, start time.Time, rowsAffected int64, err error) {
+	elapsed := time.Since(start)
+	report := self.slowQueries
+
+	logger := self.logger
+	if logger == nil {
+		logger = db.GetLogger()
+	}
+
+	if logger == nil && report.IsSlow(elapsed) == false {
+		return
+	}
+
+	if err != nil {
+		rowsAffected = -1
+	}
+
+	status := &db.QueryStatus{
+		Adapter:      driverName,
+		Query:        query,
+		Duration:     elapsed,
+		RowsAffected: rowsAffected,
+		Err:          err,
+	}
+
+	if logger != nil {
+		logger.Log(status)
+	}
+
+	// EXPLAIN output is not captured by this adapter.
+	if report.IsSlow(elapsed) {
+		report.Handler(&db.SlowQuery{QueryStatus: *status})
+	}
 }
 
 // Returns the string name of the database.
@@ -90,7 +152,7 @@ func (self *Source) Open() error {
 		self.config.Host = `127.0.0.1`
 	}
 
-	connURL.Host = fmt.Sprintf(`%s:%d`, self.config.Host, self.config.Port)
+	connURL.Host = net.JoinHostPort(self.config.Host, strconv.Itoa(self.config.Port))
 
 	if self.config.User != "" {
 		connURL.User = url.UserPassword(self.config.User, self.config.Password)
@@ -104,18 +166,116 @@ func (self *Source) Open() error {
 		return db.ErrMissingDatabaseName
 	}
 
-	if self.session, err = mgo.DialWithTimeout(connURL.String(), connTimeout); err != nil {
+	if err = util.CheckOptions(self.config.Options, options...); err != nil {
+		return err
+	}
+
+	var info *mgo.DialInfo
+
+	if info, err = mgo.ParseURL(connURL.String()); err != nil {
+		return err
+	}
+
+	info.Timeout = connTimeout
+
+	if v, ok := self.config.Options[`connectTimeoutMS`]; ok {
+		if info.Timeout, err = parseMilliseconds(`connectTimeoutMS`, v); err != nil {
+			return err
+		}
+	}
+
+	if v, ok := self.config.Options[`replicaSet`]; ok {
+		info.ReplicaSetName = v
+	}
+
+	mode := mgo.Strong
+
+	if v, ok := self.config.Options[`readPreference`]; ok {
+		if mode, ok = readPreferences[v]; ok == false {
+			return &db.OptionError{Key: `readPreference`, Value: v, Err: db.ErrInvalidOptionValue}
+		}
+	}
+
+	var socketTimeout time.Duration
+
+	if v, ok := self.config.Options[`socketTimeoutMS`]; ok {
+		if socketTimeout, err = parseMilliseconds(`socketTimeoutMS`, v); err != nil {
+			return err
+		}
+	}
+
+	if self.session, err = mgo.DialWithInfo(info); err != nil {
 		return err
 	}
 
+	self.session.SetMode(mode, true)
+
+	// mgo has no idle connection or connection lifetime settings.
+	if self.config.MaxOpenConns > 0 {
+		self.session.SetPoolLimit(self.config.MaxOpenConns)
+	}
+
+	if socketTimeout > 0 {
+		self.session.SetSocketTimeout(socketTimeout)
+	}
+
 	self.Use(self.config.Database)
 
 	return nil
 }
 
+// Clones the current database session. The clone uses a copy of the
+// underlying *mgo.Session and must be closed independently.
+func (self *Source) Clone() (db.Database, error) {
+	if self.session == nil {
+		return nil, db.ErrNotConnected
+	}
+
+	clone := &Source{}
+	clone.name = self.name
+	clone.config = self.config
+	clone.session = self.session.Copy()
+	clone.database = clone.session.DB(self.name)
+	clone.ctx = self.ctx
+	clone.logger = self.logger
+	clone.slowQueries = self.slowQueries
+
+	return clone, nil
+}
+
+// Returns error if the database server cannot be reached.
+func (self *Source) Ping() error {
+	if self.session == nil {
+		return db.ErrNotConnected
+	}
+	return self.session.Ping()
+}
+
+// Returns mgo's socket statistics. mgo keeps a single set of statistics for
+// the whole process, so they cover all the open mongo sessions.
+func (self *Source) Stats() db.Stats {
+	stats := mgo.GetStats()
+	return db.Stats{
+		OpenConnections: stats.SocketsAlive,
+		InUse:           stats.SocketsInUse,
+		Idle:            stats.SocketsAlive - stats.SocketsInUse,
+	}
+}
+
+// Sets the logger that receives the operations of this source.
+func (self *Source) SetLogger(logger db.Logger) {
+	self.logger = logger
+}
+
+// Reports the operations of this source that are slower than the threshold of
+// the given report.
+func (self *Source) SetSlowQueryReport(report *db.SlowQueryReport) {
+	self.slowQueries = report
+}
+
 // Closes the current database session.
 func (self *Source) Close() error {
-	if self.session != nil {
+	if self.session != nil && self.shared == false {
 		self.session.Close()
 	}
 	return nil
@@ -143,6 +303,44 @@ func (self *Source) End() error {
 	return nil
 }
 
+// Returns the context queries run within.
+func (self *Source) context() context.Context {
+	if self.ctx == nil {
+		return context.Background()
+	}
+	return self.ctx
+}
+
+// Returns a copy of the current source that runs all its queries within the
+// given context.
+func (self *Source) WithContext(ctx context.Context) db.Database {
+	clone := &Source{}
+	clone.name = self.name
+	clone.config = self.config
+	clone.session = self.session
+	clone.database = self.database
+	clone.ctx = ctx
+	clone.logger = self.logger
+	clone.slowQueries = self.slowQueries
+	clone.shared = true
+	return clone
+}
+
+// Raw queries are not supported by this adapter.
+func (self *Source) Query(query string, args ...interface{}) (db.Iterator, error) {
+	return nil, db.ErrFeatureNotSupported
+}
+
+// Raw statements are not supported by this adapter.
+func (self *Source) Exec(query string, args ...interface{}) (db.ExecResult, error) {
+	return nil, db.ErrFeatureNotSupported
+}
+
+// Transactions are not supported by this adapter.
+func (self *Source) Transaction() (db.Tx, error) {
+	return nil, db.ErrFeatureNotSupported
+}
+
 // Drops the currently active database.
 func (self *Source) Drop() error {
 	err := self.database.DropDatabase()
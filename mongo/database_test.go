@@ -24,10 +24,9 @@
 package mongo
 
 import (
-	"labix.org/v2/mgo"
-	"labix.org/v2/mgo/bson"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
 	"menteslibres.net/gosexy/to"
-	"os"
 	"reflect"
 	"strings"
 	"testing"
@@ -89,7 +88,7 @@ var testValues = testValuesStruct{
 
 // Enabling outputting some information to stdout, useful for development.
 func TestEnableDebug(t *testing.T) {
-	os.Setenv(db.EnvEnableDebug, "TRUE")
+	db.SetLogger(db.StdLogger)
 }
 
 // Trying to open an empty datasource, it must succeed (mongo).
@@ -103,6 +102,46 @@ func TestOpenFailed(t *testing.T) {
 }
 */
 
+// Distinct documents are grouped by the fields selected last.
+func TestDistinctGroup(t *testing.T) {
+	res := &Result{queryChunks: &chunks{Fields: []string{`*`}}}
+
+	res.Distinct()
+
+	if res.grouped() {
+		t.Fatalf("Expecting no grouping when every field is selected.")
+	}
+
+	res.Select(`name`, `born`)
+
+	if reflect.DeepEqual(res.groupFields(), []string{`name`, `born`}) == false {
+		t.Fatalf("Expecting documents to be grouped by name and born, got %v.", res.groupFields())
+	}
+}
+
+// IDs of any type are compared without panicking.
+func TestSetID(t *testing.T) {
+	id := bson.NewObjectId()
+
+	item := struct {
+		ID interface{} `bson:"_id"`
+	}{ID: map[string]int{`a`: 1}}
+
+	setID(&item, id)
+
+	if reflect.DeepEqual(item.ID, map[string]int{`a`: 1}) == false {
+		t.Fatalf("Expecting the ID to be kept, got %v.", item.ID)
+	}
+
+	item.ID = nil
+
+	setID(&item, id)
+
+	if item.ID != id {
+		t.Fatalf("Expecting ID %v, got %v.", id, item.ID)
+	}
+}
+
 // Truncates all collections.
 func TestTruncate(t *testing.T) {
 
@@ -574,7 +613,7 @@ func TestFunction(t *testing.T) {
 		t.Fatalf("One: %q", err)
 	}
 
-	res = artist.Find(db.Cond{"_id": db.Func{"$nin", []int{0, -1}}})
+	res = artist.Find(db.Cond{"_id": db.Func{Name: "$nin", Args: []int{0, -1}}})
 
 	if err = res.One(&row_s); err != nil {
 		t.Fatalf("One: %q", err)
@@ -680,7 +719,7 @@ func TestDataTypes(t *testing.T) {
 
 // We are going to benchmark the engine, so this is no longed needed.
 func TestDisableDebug(t *testing.T) {
-	os.Setenv(db.EnvEnableDebug, "")
+	db.SetLogger(nil)
 }
 
 // Benchmarking raw mgo queries.
@@ -751,3 +790,51 @@ func BenchmarkAppendStruct(b *testing.B) {
 		}
 	}
 }
+
+// Benchmarking AppendAll() with maps.
+func BenchmarkAppendAllDbItem(b *testing.B) {
+	sess, err := db.Open(wrapperName, settings)
+
+	if err != nil {
+		b.Fatalf(err.Error())
+	}
+
+	defer sess.Close()
+
+	artist, err := sess.Collection("artist")
+	artist.Truncate()
+
+	items := make([]map[string]string, b.N)
+	for i := range items {
+		items[i] = map[string]string{"name": "Leonardo DaVinci"}
+	}
+
+	b.ResetTimer()
+	if _, err = artist.AppendAll(items); err != nil {
+		b.Fatalf(err.Error())
+	}
+}
+
+// Benchmarking AppendAll() with structs.
+func BenchmarkAppendAllStruct(b *testing.B) {
+	sess, err := db.Open(wrapperName, settings)
+
+	if err != nil {
+		b.Fatalf(err.Error())
+	}
+
+	defer sess.Close()
+
+	artist, err := sess.Collection("artist")
+	artist.Truncate()
+
+	items := make([]struct{ Name string }, b.N)
+	for i := range items {
+		items[i].Name = "John Lennon"
+	}
+
+	b.ResetTimer()
+	if _, err = artist.AppendAll(items); err != nil {
+		b.Fatalf(err.Error())
+	}
+}
@@ -24,16 +24,24 @@
 package mongo
 
 import (
+	"context"
 	"errors"
-	"labix.org/v2/mgo"
-	"labix.org/v2/mgo/bson"
+	"fmt"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"strings"
+	"time"
 	"upper.io/db"
+	"upper.io/db/util"
 )
 
 type Result struct {
 	c           *Collection
 	queryChunks *chunks
 	iter        *mgo.Iter
+	ctx         context.Context
+	// Releases the collection handle the iterator was created from.
+	release func()
 }
 
 var (
@@ -43,15 +51,146 @@ var (
 // Creates a *mgo.Iter we can use in Next(), All() or One().
 func (self *Result) setCursor() error {
 	if self.iter == nil {
-		q, err := self.query()
+		col, release, err := self.c.withContext(self.context())
 		if err != nil {
 			return err
 		}
+		if self.grouped() {
+			pipeline, err := self.pipeline()
+			if err != nil {
+				release()
+				return err
+			}
+			self.iter = col.Pipe(pipeline).Iter()
+			self.release = release
+			return nil
+		}
+		q, err := self.query(col)
+		if err != nil {
+			release()
+			return err
+		}
 		self.iter = q.Iter()
+		self.release = release
 	}
 	return nil
 }
 
+// Returns true if the query must run as an aggregation pipeline.
+func (self *Result) grouped() bool {
+	return len(self.groupFields()) > 0 || len(self.queryChunks.Aggregates) > 0 || self.queryChunks.Having != nil
+}
+
+// Returns the fields documents are grouped by. Distinct documents are grouped
+// by their selected fields, unless all of them are selected, since documents
+// are already distinct by their _id.
+func (self *Result) groupFields() []string {
+	if len(self.queryChunks.Group) > 0 || self.queryChunks.Distinct == false {
+		return self.queryChunks.Group
+	}
+	for _, field := range self.queryChunks.Fields {
+		if field == `*` {
+			return nil
+		}
+	}
+	return self.queryChunks.Fields
+}
+
+// Mongo accumulators of aggregate functions.
+var accumulators = map[string]string{
+	`SUM`: `$sum`,
+	`AVG`: `$avg`,
+	`MIN`: `$min`,
+	`MAX`: `$max`,
+}
+
+// Builds the aggregation pipeline of a grouped query: documents are matched,
+// grouped, flattened so grouped fields keep their names, and then matched by
+// the conditions on groups, sorted, skipped and limited.
+func (self *Result) pipeline() ([]bson.M, error) {
+	if self.queryChunks.Err != nil {
+		return nil, self.queryChunks.Err
+	}
+
+	pipeline := []bson.M{
+		{`$match`: self.queryChunks.Conditions},
+	}
+
+	var id interface{}
+
+	project := bson.M{`_id`: 0}
+
+	if group := self.groupFields(); len(group) > 0 {
+		fields := bson.M{}
+		for _, field := range group {
+			// Keys of the _id can't have dots.
+			key := strings.Replace(field, `.`, `_`, -1)
+			fields[key] = `$` + field
+			project[field] = `$_id.` + key
+		}
+		id = fields
+	}
+
+	group := bson.M{`_id`: id}
+
+	for _, aggregate := range self.queryChunks.Aggregates {
+		fn := strings.ToUpper(aggregate.Func)
+
+		var accumulator bson.M
+
+		switch {
+		case fn == `COUNT` && aggregate.Field == `*`:
+			accumulator = bson.M{`$sum`: 1}
+		case fn == `COUNT`:
+			// Counts documents that have a value in the field.
+			accumulator = bson.M{`$sum`: bson.M{`$cond`: []interface{}{bson.M{`$gt`: []interface{}{`$` + aggregate.Field, nil}}, 1, 0}}}
+		case accumulators[fn] != ``:
+			accumulator = bson.M{accumulators[fn]: `$` + aggregate.Field}
+		default:
+			return nil, &db.QueryError{Value: aggregate.Func, Err: db.ErrUnknownAggregate}
+		}
+
+		group[aggregate.Alias()] = accumulator
+		project[aggregate.Alias()] = 1
+	}
+
+	pipeline = append(pipeline, bson.M{`$group`: group}, bson.M{`$project`: project})
+
+	if self.queryChunks.Having != nil {
+		pipeline = append(pipeline, bson.M{`$match`: self.queryChunks.Having})
+	}
+
+	if len(self.queryChunks.Sort) > 0 {
+		sort := bson.D{}
+		for _, field := range self.queryChunks.Sort {
+			if strings.HasPrefix(field, `-`) {
+				sort = append(sort, bson.DocElem{Name: field[1:], Value: -1})
+			} else {
+				sort = append(sort, bson.DocElem{Name: field, Value: 1})
+			}
+		}
+		pipeline = append(pipeline, bson.M{`$sort`: sort})
+	}
+
+	if self.queryChunks.Offset > 0 {
+		pipeline = append(pipeline, bson.M{`$skip`: self.queryChunks.Offset})
+	}
+
+	if self.queryChunks.Limit > 0 {
+		pipeline = append(pipeline, bson.M{`$limit`: self.queryChunks.Limit})
+	}
+
+	return pipeline, nil
+}
+
+// Returns the context queries run within.
+func (self *Result) context() context.Context {
+	if self.ctx == nil {
+		return self.c.parent.context()
+	}
+	return self.ctx
+}
+
 // Determines the maximum limit of results to be returned.
 func (self *Result) Limit(n uint) db.Result {
 	self.queryChunks.Limit = int(n)
@@ -68,14 +207,115 @@ func (self *Result) Skip(n uint) db.Result {
 // Determines sorting of results according to the provided names. Fields may be
 // prefixed by - (minus) which means descending order, ascending order would be
 // used otherwise.
-func (self *Result) Sort(fields ...string) db.Result {
-	self.queryChunks.Sort = fields
+func (self *Result) Sort(fields ...interface{}) db.Result {
+	var err error
+	if self.queryChunks.Sort, err = util.FieldNames(fields); err != nil && self.queryChunks.Err == nil {
+		self.queryChunks.Err = err
+	}
+	return self
+}
+
+// Retrieves only the given fields, aggregates make the query run as an
+// aggregation pipeline.
+func (self *Result) Select(fields ...interface{}) db.Result {
+	var err error
+
+	names := make([]interface{}, 0, len(fields))
+	self.queryChunks.Aggregates = nil
+
+	for _, field := range fields {
+		if aggregate, ok := field.(db.Aggregate); ok {
+			self.queryChunks.Aggregates = append(self.queryChunks.Aggregates, aggregate)
+		} else {
+			names = append(names, field)
+		}
+	}
+
+	if self.queryChunks.Fields, err = util.FieldNames(names); err != nil && self.queryChunks.Err == nil {
+		self.queryChunks.Err = err
+	}
+	return self
+}
+
+// Groups the results by the given fields.
+func (self *Result) Group(fields ...interface{}) db.Result {
+	var err error
+	if self.queryChunks.Group, err = util.FieldNames(fields); err != nil && self.queryChunks.Err == nil {
+		self.queryChunks.Err = err
+	}
 	return self
 }
 
-// Retrieves only the given fields.
-func (self *Result) Select(fields ...string) db.Result {
-	self.queryChunks.Fields = fields
+// Filters the groups of the result set by the given conditions.
+func (self *Result) Having(terms ...interface{}) db.Result {
+	var err error
+	if self.queryChunks.Having, err = self.c.compileQuery(terms...); err != nil && self.queryChunks.Err == nil {
+		self.queryChunks.Err = err
+	}
+	return self
+}
+
+// Retrieves only distinct documents of the given fields, or of the selected
+// fields if none are given. Documents are already distinct by their _id
+// otherwise.
+func (self *Result) Distinct(fields ...interface{}) db.Result {
+	var err error
+	if len(fields) > 0 {
+		if self.queryChunks.Fields, err = util.FieldNames(fields); err != nil && self.queryChunks.Err == nil {
+			self.queryChunks.Err = err
+		}
+	}
+	self.queryChunks.Distinct = true
+	return self
+}
+
+// Dumps the distinct values of the given field into a pointer to a slice.
+func (self *Result) DistinctValues(name string, dst interface{}) error {
+	if self.queryChunks.Err != nil {
+		return self.queryChunks.Err
+	}
+
+	ctx := self.context()
+
+	col, release, err := self.c.withContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	start := time.Now()
+
+	err = util.ContextError(ctx, col.Find(self.queryChunks.Conditions).Distinct(name, dst))
+
+	self.c.parent.logQuery(self.c.describe(`distinct`, name, self.queryChunks.Conditions), start, -1, err)
+
+	return err
+}
+
+// MongoDB has no joins, the result set fails with db.ErrFeatureNotSupported.
+func (self *Result) Join(table string) db.Joiner {
+	return joiner{self}
+}
+
+// MongoDB has no joins, the result set fails with db.ErrFeatureNotSupported.
+func (self *Result) LeftJoin(table string) db.Joiner {
+	return joiner{self}
+}
+
+type joiner struct {
+	result *Result
+}
+
+func (self joiner) On(terms ...interface{}) db.Result {
+	if self.result.queryChunks.Err == nil {
+		self.result.queryChunks.Err = db.ErrFeatureNotSupported
+	}
+	return self.result
+}
+
+// Runs the queries of this result set within the given context.
+func (self *Result) WithContext(ctx context.Context) db.Result {
+	self.ctx = ctx
 	return self
 }
 
@@ -84,21 +324,25 @@ func (self *Result) All(dst interface{}) error {
 
 	var err error
 
+	start := time.Now()
+
 	err = self.setCursor()
 
 	if err != nil {
 		return err
 	}
 
-	err = self.iter.All(dst)
+	err = util.ContextError(self.context(), self.iter.All(dst))
+	self.c.parent.logQuery(self.describe(), start, -1, err)
 
 	if err != nil {
+		self.Close()
 		return err
 	}
 
 	self.Close()
 
-	return nil
+	return util.FetchRelations(self.context(), self.c.parent, dst)
 }
 
 // Fetches only one result from the resultset.
@@ -112,21 +356,39 @@ func (self *Result) One(dst interface{}) error {
 
 	self.Close()
 
-	return nil
+	return util.FetchRelations(self.context(), self.c.parent, dst)
 }
 
 // Fetches the next result from the resultset.
 func (self *Result) Next(dst interface{}) error {
+	start := time.Now()
+	fresh := self.iter == nil
+
 	err := self.setCursor()
 
 	if err != nil {
 		return err
 	}
 
+	ctx := self.context()
+
+	if err = ctx.Err(); err != nil {
+		self.Close()
+		return util.ContextError(ctx, err)
+	}
+
 	success := self.iter.Next(dst)
 
 	if success == false {
-		err := self.iter.Err()
+		err = util.ContextError(ctx, self.iter.Err())
+	}
+
+	// The query is sent along with the first fetch.
+	if fresh {
+		self.c.parent.logQuery(self.describe(), start, -1, err)
+	}
+
+	if success == false {
 		if err == nil {
 			return db.ErrNoMoreRows
 		}
@@ -138,12 +400,44 @@ func (self *Result) Next(dst interface{}) error {
 
 // Removes the matching items from the collection.
 func (self *Result) Remove() error {
-	var err error
-	_, err = self.c.collection.RemoveAll(self.queryChunks.Conditions)
+	_, err := self.RemoveAffected()
+	return err
+}
+
+// Removes the matching items from the collection and returns the number of
+// documents that were removed.
+func (self *Result) RemoveAffected() (uint64, error) {
+	if self.queryChunks.Err != nil {
+		return 0, self.queryChunks.Err
+	}
+
+	ctx := self.context()
+
+	col, release, err := self.c.withContext(ctx)
 	if err != nil {
-		return err
+		return 0, err
 	}
-	return nil
+	defer release()
+
+	var info *mgo.ChangeInfo
+	var removed int64
+
+	start := time.Now()
+
+	info, err = col.RemoveAll(self.queryChunks.Conditions)
+	err = util.ContextError(ctx, err)
+
+	if info != nil {
+		removed = int64(info.Removed)
+	}
+
+	self.c.parent.logQuery(self.c.describe(`remove`, self.queryChunks.Conditions), start, removed, err)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return uint64(removed), nil
 }
 
 // Closes the result set.
@@ -153,24 +447,94 @@ func (self *Result) Close() error {
 		err = self.iter.Close()
 		self.iter = nil
 	}
+	if self.release != nil {
+		self.release()
+		self.release = nil
+	}
 	return err
 }
 
 // Updates matching items from the collection with values of the given map or
 // struct.
 func (self *Result) Update(src interface{}) error {
-	var err error
-	_, err = self.c.collection.UpdateAll(self.queryChunks.Conditions, map[string]interface{}{"$set": src})
+	_, err := self.UpdateAffected(src)
+	return err
+}
+
+// Updates the matching items from the collection with values of the given map
+// or struct and returns the number of documents that matched.
+func (self *Result) UpdateAffected(src interface{}) (uint64, error) {
+	if self.queryChunks.Err != nil {
+		return 0, self.queryChunks.Err
+	}
+
+	ctx := self.context()
+
+	col, release, err := self.c.withContext(ctx)
 	if err != nil {
-		return err
+		return 0, err
 	}
-	return nil
+	defer release()
+
+	if values, ok := src.(map[string]interface{}); ok {
+		for _, value := range values {
+			if _, ok := value.(db.Raw); ok {
+				return 0, db.ErrFeatureNotSupported
+			}
+		}
+	}
+
+	var info *mgo.ChangeInfo
+	var updated, matched int64
+
+	change := map[string]interface{}{"$set": src}
+
+	start := time.Now()
+
+	info, err = col.UpdateAll(self.queryChunks.Conditions, change)
+	err = util.ContextError(ctx, err)
+
+	if info != nil {
+		updated = int64(info.Updated)
+		matched = int64(info.Matched)
+	}
+
+	self.c.parent.logQuery(self.c.describe(`update`, self.queryChunks.Conditions, change), start, updated, err)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return uint64(matched), nil
+}
+
+// Returns a mongo shell-like representation of the query, for logging.
+func (self *Result) describe() string {
+	if self.grouped() {
+		pipeline, _ := self.pipeline()
+		return self.c.describe(`aggregate`, pipeline)
+	}
+	s := self.c.describe(`find`, self.queryChunks.Conditions)
+	if len(self.queryChunks.Sort) > 0 {
+		s = s + fmt.Sprintf(`.sort(%v)`, self.queryChunks.Sort)
+	}
+	if self.queryChunks.Offset > 0 {
+		s = s + fmt.Sprintf(`.skip(%d)`, self.queryChunks.Offset)
+	}
+	if self.queryChunks.Limit > 0 {
+		s = s + fmt.Sprintf(`.limit(%d)`, self.queryChunks.Limit)
+	}
+	return s
 }
 
-func (self *Result) query() (*mgo.Query, error) {
+func (self *Result) query(col *mgo.Collection) (*mgo.Query, error) {
 	var err error
 
-	q := self.c.collection.Find(self.queryChunks.Conditions)
+	if self.queryChunks.Err != nil {
+		return nil, self.queryChunks.Err
+	}
+
+	q := col.Find(self.queryChunks.Conditions)
 
 	if self.queryChunks.Offset > 0 {
 		q = q.Skip(self.queryChunks.Offset)
@@ -200,7 +564,58 @@ func (self *Result) query() (*mgo.Query, error) {
 
 // Counts matching elements.
 func (self *Result) Count() (uint64, error) {
-	q := self.c.collection.Find(self.queryChunks.Conditions)
+	if self.queryChunks.Err != nil {
+		return 0, self.queryChunks.Err
+	}
+
+	ctx := self.context()
+
+	col, release, err := self.c.withContext(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+
+	start := time.Now()
+
+	if self.grouped() {
+		return self.countGroups(col, start)
+	}
+
+	q := col.Find(self.queryChunks.Conditions)
 	total, err := q.Count()
+	err = util.ContextError(ctx, err)
+
+	self.c.parent.logQuery(self.c.describe(`count`, self.queryChunks.Conditions), start, -1, err)
+
 	return uint64(total), err
 }
+
+// Counts the groups of a grouped query, regardless of its sort order, offset
+// and limit.
+func (self *Result) countGroups(col *mgo.Collection, start time.Time) (uint64, error) {
+	chunks := *self.queryChunks
+	chunks.Sort, chunks.Offset, chunks.Limit = nil, 0, 0
+
+	pipeline, err := (&Result{c: self.c, queryChunks: &chunks}).pipeline()
+	if err != nil {
+		return 0, err
+	}
+
+	pipeline = append(pipeline, bson.M{`$group`: bson.M{`_id`: nil, `total`: bson.M{`$sum`: 1}}})
+
+	var res struct {
+		Total uint64 `bson:"total"`
+	}
+
+	err = col.Pipe(pipeline).One(&res)
+	if err == mgo.ErrNotFound {
+		// No groups.
+		err = nil
+	}
+	err = util.ContextError(self.context(), err)
+
+	self.c.parent.logQuery(self.c.describe(`aggregate`, pipeline), start, -1, err)
+
+	return res.Total, err
+}
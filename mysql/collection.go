@@ -27,10 +27,8 @@ import (
 	"fmt"
 	_ "github.com/go-sql-driver/mysql"
 	"menteslibres.net/gosexy/to"
-	"reflect"
-	"strings"
 	"time"
-	"upper.io/db"
+	"upper.io/db/util/sqlgen"
 	"upper.io/db/util/sqlutil"
 )
 
@@ -40,182 +38,47 @@ type Table struct {
 	sqlutil.T
 }
 
-// Creates a filter with the given terms.
-func (self *Table) Find(terms ...interface{}) db.Result {
-
-	queryChunks := sqlutil.NewQueryChunks()
-
-	// No specific fields given.
-	if len(queryChunks.Fields) == 0 {
-		queryChunks.Fields = []string{`*`}
-	}
-
-	// Compiling conditions
-	queryChunks.Conditions, queryChunks.Arguments = self.compileConditions(terms)
-
-	if queryChunks.Conditions == "" {
-		queryChunks.Conditions = `1 = 1`
-	}
-
-	// Creating a result handler.
-	result := &Result{
-		self,
-		queryChunks,
-		nil,
-	}
-
-	return result
-}
-
-// Transforms conditions into arguments for sql.Exec/sql.Query
-func (self *Table) compileConditions(term interface{}) (string, []interface{}) {
-	sql := []string{}
-	args := []interface{}{}
-
-	switch t := term.(type) {
-	case []interface{}:
-		for i := range t {
-			rsql, rargs := self.compileConditions(t[i])
-			if rsql != "" {
-				sql = append(sql, rsql)
-				args = append(args, rargs...)
-			}
-		}
-		if len(sql) > 0 {
-			return `(` + strings.Join(sql, ` AND `) + `)`, args
-		}
-	case db.Or:
-		for i := range t {
-			rsql, rargs := self.compileConditions(t[i])
-			if rsql != "" {
-				sql = append(sql, rsql)
-				args = append(args, rargs...)
-			}
-		}
-		if len(sql) > 0 {
-			return `(` + strings.Join(sql, ` OR `) + `)`, args
-		}
-	case db.And:
-		for i := range t {
-			rsql, rargs := self.compileConditions(t[i])
-			if rsql != "" {
-				sql = append(sql, rsql)
-				args = append(args, rargs...)
-			}
-		}
-		if len(sql) > 0 {
-			return `(` + strings.Join(sql, ` AND `) + `)`, args
-		}
-	case db.Cond:
-		return self.compileStatement(t)
-	}
-
-	return "", args
-}
-
-func (self *Table) compileStatement(cond db.Cond) (string, []interface{}) {
-
-	total := len(cond)
-
-	str := make([]string, 0, total)
-	arg := make([]interface{}, 0, total)
-
-	// Walking over conditions
-	for field, value := range cond {
-		// Removing leading or trailing spaces.
-		field = strings.TrimSpace(field)
-
-		chunks := strings.SplitN(field, ` `, 2)
-
-		// Default operator.
-		op := `=`
-
-		if len(chunks) > 1 {
-			// User has defined a different operator.
-			op = chunks[1]
-		}
-
-		switch value := value.(type) {
-		case db.Func:
-			value_i := interfaceArgs(value.Args)
-			if value_i == nil {
-				str = append(str, fmt.Sprintf(`%s %s ()`, chunks[0], value.Name))
-			} else {
-				str = append(str, fmt.Sprintf(`%s %s (?%s)`, chunks[0], value.Name, strings.Repeat(`,?`, len(value_i)-1)))
-				arg = append(arg, value_i...)
-			}
-		default:
-			value_i := interfaceArgs(value)
-			if value_i == nil {
-				str = append(str, fmt.Sprintf(`%s %s ()`, chunks[0], op))
-			} else {
-				str = append(str, fmt.Sprintf(`%s %s (?%s)`, chunks[0], op, strings.Repeat(`,?`, len(value_i)-1)))
-				arg = append(arg, value_i...)
-			}
-		}
-	}
-
-	switch len(str) {
-	case 1:
-		return str[0], arg
-	case 0:
-		return "", []interface{}{}
-	}
-
-	return `(` + strings.Join(str, ` AND `) + `)`, arg
-}
-
-// Deletes all the rows within the collection.
-func (self *Table) Truncate() error {
-
-	_, err := self.source.doExec(
-		fmt.Sprintf("TRUNCATE TABLE `%s`", self.Name()),
-	)
-
-	return err
-}
-
-// Appends an item (map or struct) into the collection.
-func (self *Table) Append(item interface{}) (interface{}, error) {
-	var id interface{}
-
-	fields, values, err := self.FieldValues(item, toInternal)
+// Returns the columns of the primary key of the table, in order.
+func (self *Table) primaryKeys() ([]string, error) {
+	rows, err := self.source.doQuery(sqlgen.RawQuery(
+		fmt.Sprintf(
+			"SHOW KEYS FROM `%s` WHERE Key_name = 'PRIMARY'",
+			self.Name(),
+		),
+	))
 
-	// Error ocurred, stop appending.
 	if err != nil {
 		return nil, err
 	}
 
-	res, err := self.source.doExec(
-		fmt.Sprintf("INSERT INTO `%s`", self.Name()),
-		sqlFields(fields),
-		"VALUES",
-		sqlValues(values),
-	)
+	// Keys are listed in the order of their columns within the index.
+	keys := []struct {
+		ColumnName string
+	}{}
 
-	// Error ocurred, stop appending.
-	if err != nil {
+	if err = self.FetchRows(&keys, rows); err != nil {
 		return nil, err
 	}
 
-	// Last inserted ID could be zero too.
-	id, _ = res.LastInsertId()
+	columns := make([]string, len(keys))
+
+	for i := range keys {
+		columns[i] = keys[i].ColumnName
+	}
 
-	return id, nil
+	return columns, nil
 }
 
 // Returns true if the collection exists.
 func (self *Table) Exists() bool {
-	rows, err := self.source.doQuery(
-		fmt.Sprintf(`
-				SELECT table_name
-					FROM information_schema.tables
-				WHERE table_schema = '%s' AND table_name = '%s'
-			`,
-			self.source.Name(),
-			self.Name(),
-		),
-	)
+	rows, err := self.source.doQuery(sqlgen.RawQuery(`
+			SELECT table_name
+				FROM information_schema.tables
+			WHERE table_schema = ? AND table_name = ?
+		`,
+		self.source.Name(),
+		self.Name(),
+	))
 
 	if err != nil {
 		return false
@@ -255,34 +118,3 @@ func toInternal(val interface{}) interface{} {
 func toNative(val interface{}) interface{} {
 	return val
 }
-
-func interfaceArgs(value interface{}) (args []interface{}) {
-
-	if value == nil {
-		return nil
-	}
-
-	value_v := reflect.ValueOf(value)
-
-	switch value_v.Type().Kind() {
-	case reflect.Slice:
-		var i, total int
-
-		total = value_v.Len()
-		if total > 0 {
-			args = make([]interface{}, total)
-
-			for i = 0; i < total; i++ {
-				args[i] = toInternal(value_v.Index(i).Interface())
-			}
-
-			return args
-		} else {
-			return nil
-		}
-	default:
-		args = []interface{}{toInternal(value)}
-	}
-
-	return args
-}
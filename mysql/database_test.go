@@ -36,12 +36,12 @@ package mysql
 import (
 	"database/sql"
 	"menteslibres.net/gosexy/to"
-	"os"
 	"reflect"
 	"strings"
 	"testing"
 	"time"
 	"upper.io/db"
+	"upper.io/db/util/sqlgen"
 )
 
 // Wrapper.
@@ -101,7 +101,7 @@ var testValues = testValuesStruct{
 // Enabling outputting some information to stdout (like the SQL query and its
 // arguments), useful for development.
 func TestEnableDebug(t *testing.T) {
-	os.Setenv(db.EnvEnableDebug, "TRUE")
+	db.SetLogger(db.StdLogger)
 }
 
 // Trying to open an empty datasource, it must fail.
@@ -113,6 +113,39 @@ func TestOpenFailed(t *testing.T) {
 	}
 }
 
+// Custom TLS config names are left to the driver.
+func TestCheckOption(t *testing.T) {
+	for _, v := range []string{`true`, `skip-verify`, `custom`} {
+		if err := checkOption(`tls`, v); err != nil {
+			t.Fatalf("Expecting tls=%s to be accepted, got %v.", v, err)
+		}
+	}
+
+	if err := checkOption(`tls`, ``); err == nil {
+		t.Fatalf("Expecting an error.")
+	}
+}
+
+// Matching operators are case sensitive.
+func TestMatch(t *testing.T) {
+	tests := map[string]string{
+		`name LIKE`:       "SELECT * FROM `artist` WHERE (`name` LIKE BINARY ?)",
+		`name REGEXP`:     "SELECT * FROM `artist` WHERE (BINARY `name` REGEXP ?)",
+		`name NOT REGEXP`: "SELECT * FROM `artist` WHERE (BINARY `name` NOT REGEXP ?)",
+	}
+
+	for key, expected := range tests {
+		stmt := sqlgen.Statement{Type: sqlgen.Select, Table: `artist`, Where: []interface{}{db.Cond{key: `^H`}}}
+		query, _, err := stmt.Compile(dialect{})
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		if query != expected {
+			t.Fatalf("Expecting %s, got %s.", expected, query)
+		}
+	}
+}
+
 // Truncates all collections.
 func TestTruncate(t *testing.T) {
 
@@ -547,7 +580,7 @@ func TestFunction(t *testing.T) {
 		t.Fatalf("One: %q", err)
 	}
 
-	res = artist.Find(db.Cond{"id": db.Func{"NOT IN", []int{0, -1}}})
+	res = artist.Find(db.Cond{"id": db.Func{Name: "NOT IN", Args: []int{0, -1}}})
 
 	if err = res.One(&row_s); err != nil {
 		t.Fatalf("One: %q", err)
@@ -641,7 +674,7 @@ func TestDataTypes(t *testing.T) {
 
 // We are going to benchmark the engine, so this is no longed needed.
 func TestDisableDebug(t *testing.T) {
-	os.Setenv(db.EnvEnableDebug, "")
+	db.SetLogger(nil)
 }
 
 // Benchmarking raw database/sql.
@@ -749,3 +782,51 @@ func BenchmarkAppendStruct(b *testing.B) {
 		}
 	}
 }
+
+// Benchmarking AppendAll() with maps.
+func BenchmarkAppendAllDbItem(b *testing.B) {
+	sess, err := db.Open(wrapperName, settings)
+
+	if err != nil {
+		b.Fatalf(err.Error())
+	}
+
+	defer sess.Close()
+
+	artist, err := sess.Collection("artist")
+	artist.Truncate()
+
+	items := make([]map[string]string, b.N)
+	for i := range items {
+		items[i] = map[string]string{"name": "Leonardo DaVinci"}
+	}
+
+	b.ResetTimer()
+	if _, err = artist.AppendAll(items); err != nil {
+		b.Fatalf(err.Error())
+	}
+}
+
+// Benchmarking AppendAll() with structs.
+func BenchmarkAppendAllStruct(b *testing.B) {
+	sess, err := db.Open(wrapperName, settings)
+
+	if err != nil {
+		b.Fatalf(err.Error())
+	}
+
+	defer sess.Close()
+
+	artist, err := sess.Collection("artist")
+	artist.Truncate()
+
+	items := make([]struct{ Name string }, b.N)
+	for i := range items {
+		items[i].Name = "John Lennon"
+	}
+
+	b.ResetTimer()
+	if _, err = artist.AppendAll(items); err != nil {
+		b.Fatalf(err.Error())
+	}
+}
@@ -0,0 +1,117 @@
+/*
+  Copyright (c) 2012-2014 José Carlos Nieto, https://menteslibres.net/xiam
+
+  Permission is hereby granted, free of charge, to any person obtaining
+  a copy of this software and associated documentation files (the
+  "Software"), to deal in the Software without restriction, including
+  without limitation the rights to use, copy, modify, merge, publish,
+  distribute, sublicense, and/or sell copies of the Software, and to
+  permit persons to whom the Software is furnished to do so, subject to
+  the following conditions:
+
+  The above copyright notice and this permission notice shall be
+  included in all copies or substantial portions of the Software.
+
+  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+  EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+  MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+  NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+  LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+  OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+  WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+
+package mysql
+
+import (
+	"strings"
+	"upper.io/db/util/sqlgen"
+)
+
+// MySQL syntax for sqlgen.
+type dialect struct{}
+
+// MySQL operators besides the standard ones.
+var operators = map[string]bool{
+	`<=>`:       true,
+	`RLIKE`:     true,
+	`NOT RLIKE`: true,
+}
+
+func (self dialect) QuoteIdentifier(name string) (string, bool) {
+	return "`" + strings.Replace(name, "`", "``", -1) + "`", true
+}
+
+func (self dialect) Placeholder(n int) string {
+	return `?`
+}
+
+func (self dialect) Operator(op string) (string, bool) {
+	if operators[op] {
+		return op, true
+	}
+	return sqlgen.StandardOperator(op)
+}
+
+// MySQL compares strings case insensitively under most collations, BINARY
+// makes LIKE and REGEXP case sensitive as they are elsewhere. REGEXP takes it on
+// the column, since MySQL 8.0.22 rejects a binary pattern against a utf8mb4
+// column.
+func (self dialect) Match(column string, op string, pattern string, bind func(interface{}) string) string {
+	switch op {
+	case `ILIKE`:
+		return `LOWER(` + column + `) LIKE LOWER(` + bind(pattern) + `)`
+	case `NOT ILIKE`:
+		return `LOWER(` + column + `) NOT LIKE LOWER(` + bind(pattern) + `)`
+	case `REGEXP`, `NOT REGEXP`:
+		return `BINARY ` + column + ` ` + op + ` ` + bind(pattern)
+	}
+	return column + ` ` + op + ` BINARY ` + bind(pattern)
+}
+
+// MySQL does not accept OFFSET without LIMIT.
+func (self dialect) LimitOffset(limit int, offset int) string {
+	if limit == 0 && offset > 0 {
+		return `LIMIT 18446744073709551615 ` + sqlgen.LimitOffset(0, offset)
+	}
+	return sqlgen.LimitOffset(limit, offset)
+}
+
+func (self dialect) Truncate(table string) string {
+	return `TRUNCATE TABLE ` + table
+}
+
+func (self dialect) SupportsHaving() bool {
+	return true
+}
+
+func (self dialect) Join(kind string) (string, bool) {
+	return kind, true
+}
+
+func (self dialect) SupportsReturning() bool {
+	return false
+}
+
+// Prepared statements can't have more than 65535 placeholders.
+func (self dialect) MaxArguments() int {
+	return 65535
+}
+
+// MySQL updates the row that conflicts on any unique key, there's no way to
+// tell which one.
+func (self dialect) OnConflict(conflict []string, update []string) (string, bool) {
+	if len(update) == 0 {
+		// Nothing to update, but the row must not be inserted either.
+		return `ON DUPLICATE KEY UPDATE ` + conflict[0] + ` = ` + conflict[0], true
+	}
+	set := make([]string, len(update))
+	for i := range update {
+		set[i] = update[i] + ` = VALUES(` + update[i] + `)`
+	}
+	return `ON DUPLICATE KEY UPDATE ` + strings.Join(set, `, `), true
+}
+
+func (self dialect) Value(v interface{}) interface{} {
+	return toInternal(v)
+}
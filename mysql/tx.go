@@ -0,0 +1,77 @@
+/*
+  Copyright (c) 2012-2014 José Carlos Nieto, https://menteslibres.net/xiam
+
+  Permission is hereby granted, free of charge, to any person obtaining
+  a copy of this software and associated documentation files (the
+  "Software"), to deal in the Software without restriction, including
+  without limitation the rights to use, copy, modify, merge, publish,
+  distribute, sublicense, and/or sell copies of the Software, and to
+  permit persons to whom the Software is furnished to do so, subject to
+  the following conditions:
+
+  The above copyright notice and this permission notice shall be
+  included in all copies or substantial portions of the Software.
+
+  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+  EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+  MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+  NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+  LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+  OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+  WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+
+package mysql
+
+import (
+	"database/sql"
+	"upper.io/db/util/sqlgen"
+)
+
+// Represents a transaction. A Tx can be used as a db.Database, collections and
+// results obtained from it are bound to the transaction.
+type Tx struct {
+	*Source
+	// Name of the savepoint that backs a nested transaction.
+	savepoint string
+	done      bool
+}
+
+// Commits the current transaction. Committing a nested transaction releases
+// its savepoint, changes are not persisted until the outermost transaction is
+// committed.
+func (self *Tx) Commit() error {
+	if self.savepoint != "" {
+		_, err := self.doExec(sqlgen.RawQuery(`RELEASE SAVEPOINT ` + self.savepoint))
+		self.done = err == nil
+		return err
+	}
+	return self.Source.tx.Commit()
+}
+
+// Discards all the instructions on the current transaction. Rolling back a
+// nested transaction only discards the instructions issued after its
+// savepoint.
+func (self *Tx) Rollback() error {
+	if self.savepoint != "" {
+		_, err := self.doExec(sqlgen.RawQuery(`ROLLBACK TO SAVEPOINT ` + self.savepoint))
+		self.done = err == nil
+		return err
+	}
+	return self.Source.tx.Rollback()
+}
+
+// Rolls back the transaction if it was not committed. The underlying session
+// is not closed.
+func (self *Tx) Close() error {
+	if self.savepoint != "" {
+		if self.done {
+			return nil
+		}
+		return self.Rollback()
+	}
+	if err := self.Source.tx.Rollback(); err != sql.ErrTxDone {
+		return err
+	}
+	return nil
+}
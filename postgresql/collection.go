@@ -28,9 +28,9 @@ import (
 	"fmt"
 	"menteslibres.net/gosexy/to"
 	"reflect"
-	"strings"
 	"time"
 	"upper.io/db"
+	"upper.io/db/util/sqlgen"
 	"upper.io/db/util/sqlutil"
 )
 
@@ -40,194 +40,212 @@ type Table struct {
 	sqlutil.T
 }
 
-func (self *Table) Find(terms ...interface{}) db.Result {
-
-	queryChunks := sqlutil.NewQueryChunks()
-
-	// No specific fields given.
-	if len(queryChunks.Fields) == 0 {
-		queryChunks.Fields = []string{`*`}
-	}
+// Appends an item (map or struct) into the collection.
+func (self *Table) Append(item interface{}) (interface{}, error) {
 
-	// Compiling conditions
-	queryChunks.Conditions, queryChunks.Arguments = self.compileConditions(terms)
+	fields, values, err := self.FieldValues(item, toInternal)
 
-	if queryChunks.Conditions == "" {
-		queryChunks.Conditions = `1 = 1`
+	// Error ocurred, stop appending.
+	if err != nil {
+		return nil, err
 	}
 
-	// Creating a result handler.
-	result := &Result{
-		self,
-		queryChunks,
-		nil,
+	stmt := &sqlgen.Statement{
+		Type:    sqlgen.Insert,
+		Table:   self.Name(),
+		Columns: fields,
+		Values:  values,
 	}
 
-	return result
-}
+	// A pointer gets the row as it was stored, including the values the
+	// database generated.
+	if reflect.TypeOf(item).Kind() == reflect.Ptr {
+		stmt.Returning = []string{`*`}
 
-// Transforms conditions into arguments for sql.Exec/sql.Query
-func (self *Table) compileConditions(term interface{}) (string, []interface{}) {
-	sql := []string{}
-	args := []interface{}{}
-
-	switch t := term.(type) {
-	case []interface{}:
-		for i := range t {
-			rsql, rargs := self.compileConditions(t[i])
-			if rsql != "" {
-				sql = append(sql, rsql)
-				args = append(args, rargs...)
-			}
-		}
-		if len(sql) > 0 {
-			return `(` + strings.Join(sql, ` AND `) + `)`, args
+		rows, err := self.source.doQuery(stmt)
+		if err != nil {
+			return nil, err
 		}
-	case db.Or:
-		for i := range t {
-			rsql, rargs := self.compileConditions(t[i])
-			if rsql != "" {
-				sql = append(sql, rsql)
-				args = append(args, rargs...)
-			}
-		}
-		if len(sql) > 0 {
-			return `(` + strings.Join(sql, ` OR `) + `)`, args
-		}
-	case db.And:
-		for i := range t {
-			rsql, rargs := self.compileConditions(t[i])
-			if rsql != "" {
-				sql = append(sql, rsql)
-				args = append(args, rargs...)
-			}
-		}
-		if len(sql) > 0 {
-			return `(` + strings.Join(sql, ` AND `) + `)`, args
+		defer rows.Close()
+
+		key, err := self.FetchRowKey(item, rows, self.returning())
+		if err != nil {
+			return nil, err
 		}
-	case db.Cond:
-		return self.compileStatement(t)
+
+		return keyID(key), nil
 	}
 
-	return "", args
-}
+	stmt.Returning = self.returning()
 
-func (self *Table) compileStatement(cond db.Cond) (string, []interface{}) {
+	row, err := self.source.doQueryRow(stmt)
 
-	total := len(cond)
+	if err != nil {
+		return nil, err
+	}
 
-	str := make([]string, 0, total)
-	arg := make([]interface{}, 0, total)
+	id, err := scanKey(row, len(stmt.Returning))
 
-	// Walking over conditions
-	for field, value := range cond {
-		// Removing leading or trailing spaces.
-		field = strings.TrimSpace(field)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			// Can't tell the row's id. Maybe there isn't any?
+			return nil, nil
+		}
+		// Other kind of error.
+		return nil, err
+	}
 
-		chunks := strings.SplitN(field, ` `, 2)
+	return id, nil
+}
 
-		// Default operator.
-		op := `=`
+// Returns the columns an INSERT statement returns as the id of the new row,
+// tables without a primary key fall back to their id column, if any.
+func (self *Table) returning() []string {
+	if len(self.PrimaryKeys) > 0 {
+		return self.PrimaryKeys
+	}
+	if _, ok := self.ColumnTypes[`id`]; ok == true {
+		return []string{`id`}
+	}
+	return nil
+}
 
-		if len(chunks) > 1 {
-			// User has defined a different operator.
-			op = chunks[1]
-		}
+// Scans the n columns of the key an INSERT statement returns, composite keys
+// are returned as a db.Key.
+func scanKey(row interface {
+	Scan(...interface{}) error
+}, n int) (interface{}, error) {
+	key := make(db.Key, n)
 
-		switch value := value.(type) {
-		case db.Func:
-			value_i := interfaceArgs(value.Args)
-			if value_i == nil {
-				str = append(str, fmt.Sprintf(`%s %s ()`, chunks[0], value.Name))
-			} else {
-				str = append(str, fmt.Sprintf(`%s %s (?%s)`, chunks[0], value.Name, strings.Repeat(`,?`, len(value_i)-1)))
-				arg = append(arg, value_i...)
-			}
-		default:
-			value_i := interfaceArgs(value)
-			if value_i == nil {
-				str = append(str, fmt.Sprintf(`%s %s ()`, chunks[0], op))
-			} else {
-				str = append(str, fmt.Sprintf(`%s %s (?%s)`, chunks[0], op, strings.Repeat(`,?`, len(value_i)-1)))
-				arg = append(arg, value_i...)
-			}
-		}
+	dst := make([]interface{}, len(key))
+	for i := range key {
+		dst[i] = &key[i]
 	}
 
-	switch len(str) {
-	case 1:
-		return str[0], arg
-	case 0:
-		return "", []interface{}{}
+	if err := row.Scan(dst...); err != nil {
+		return nil, err
 	}
 
-	return `(` + strings.Join(str, ` AND `) + `)`, arg
-}
-
-// Deletes all the rows within the collection.
-func (t *Table) Truncate() error {
-
-	_, err := t.source.doExec(
-		fmt.Sprintf(`TRUNCATE TABLE "%s"`, t.Name()),
-	)
+	for i := range key {
+		if b, ok := key[i].([]byte); ok {
+			key[i] = string(b)
+		}
+	}
 
-	return err
+	return keyID(key), nil
 }
 
-// Appends an item (map or struct) into the collection.
-func (self *Table) Append(item interface{}) (interface{}, error) {
+// Returns the value of a single column key, or the key itself if it's
+// composite.
+func keyID(key db.Key) interface{} {
+	switch len(key) {
+	case 0:
+		return nil
+	case 1:
+		return key[0]
+	}
+	return key
+}
 
-	fields, values, err := self.FieldValues(item, toInternal)
+// Appends the items of a slice of maps or structs into the collection with
+// multi-row INSERT statements, split to stay within the driver's limit of
+// arguments. Statements are not atomic as a whole unless they run within a
+// transaction.
+func (self *Table) AppendAll(items interface{}) ([]interface{}, error) {
+	stmts, err := self.InsertStatements(self.Name(), items, toInternal)
 
-	// Error ocurred, stop appending.
 	if err != nil {
 		return nil, err
 	}
 
-	tail := ""
+	returning := self.returning()
+
+	ids := []interface{}{}
+
+	for _, stmt := range stmts {
+		for _, batch := range stmt.Split(dialect{}) {
+			if len(returning) == 0 {
+				if _, err = self.source.doExec(batch); err != nil {
+					return ids, err
+				}
+				for range batch.Rows {
+					ids = append(ids, nil)
+				}
+				continue
+			}
+
+			batch.Returning = returning
+
+			rows, err := self.source.doQuery(batch)
+			if err != nil {
+				return ids, err
+			}
+
+			for rows.Next() {
+				id, err := scanKey(rows, len(returning))
+				if err != nil {
+					rows.Close()
+					return ids, err
+				}
+				ids = append(ids, id)
+			}
 
-	if _, ok := self.ColumnTypes[self.PrimaryKey]; ok == true {
-		tail = fmt.Sprintf(`RETURNING %s`, self.PrimaryKey)
+			rows.Close()
+
+			if err = rows.Err(); err != nil {
+				return ids, err
+			}
+		}
 	}
 
-	row, err := self.source.doQueryRow(
-		fmt.Sprintf(`INSERT INTO "%s"`, self.Name()),
-		sqlFields(fields),
-		`VALUES`,
-		sqlValues(values),
-		tail,
-	)
+	return ids, nil
+}
+
+// Returns the columns of the primary key of the table, in order.
+func (self *Table) primaryKeys() ([]string, error) {
+	rows, err := self.source.doQuery(sqlgen.RawQuery(`
+			SELECT kcu.column_name
+				FROM information_schema.table_constraints tc
+				JOIN information_schema.key_column_usage kcu
+					ON kcu.constraint_name = tc.constraint_name
+					AND kcu.table_schema = tc.table_schema
+					AND kcu.table_name = tc.table_name
+			WHERE tc.table_catalog = ? AND tc.table_name = ? AND tc.constraint_type = 'PRIMARY KEY'
+			ORDER BY kcu.ordinal_position
+		`,
+		self.source.Name(),
+		self.Name(),
+	))
 
 	if err != nil {
 		return nil, err
 	}
 
-	var id int64
+	defer rows.Close()
 
-	if err = row.Scan(&id); err != nil {
-		if err == sql.ErrNoRows {
-			// Can't tell the row's id. Maybe there isn't any?
-			return nil, nil
+	keys := []string{}
+
+	for rows.Next() {
+		var key string
+		if err = rows.Scan(&key); err != nil {
+			return nil, err
 		}
-		// Other kind of error.
-		return nil, err
+		keys = append(keys, key)
 	}
 
-	return id, nil
+	return keys, rows.Err()
 }
 
 // Returns true if the collection exists.
 func (self *Table) Exists() bool {
-	rows, err := self.source.doQuery(
-		fmt.Sprintf(`
-				SELECT table_name
-					FROM information_schema.tables
-				WHERE table_catalog = '%s' AND table_name = '%s'
+	rows, err := self.source.doQuery(sqlgen.RawQuery(`
+			SELECT table_name
+				FROM information_schema.tables
+			WHERE table_catalog = ? AND table_name = ?
 		`,
-			self.source.Name(),
-			self.Name(),
-		),
-	)
+		self.source.Name(),
+		self.Name(),
+	))
 
 	if err != nil {
 		return false
@@ -265,34 +283,3 @@ func toInternal(val interface{}) interface{} {
 func toNative(val interface{}) interface{} {
 	return val
 }
-
-func interfaceArgs(value interface{}) (args []interface{}) {
-
-	if value == nil {
-		return nil
-	}
-
-	value_v := reflect.ValueOf(value)
-
-	switch value_v.Type().Kind() {
-	case reflect.Slice:
-		var i, total int
-
-		total = value_v.Len()
-		if total > 0 {
-			args = make([]interface{}, total)
-
-			for i = 0; i < total; i++ {
-				args[i] = toInternal(value_v.Index(i).Interface())
-			}
-
-			return args
-		} else {
-			return nil
-		}
-	default:
-		args = []interface{}{toInternal(value)}
-	}
-
-	return args
-}
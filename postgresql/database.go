@@ -24,15 +24,20 @@
 package postgresql
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	_ "github.com/xiam/gopostgresql"
-	"log"
-	"os"
 	"reflect"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 	"upper.io/db"
+	"upper.io/db/util"
+	"upper.io/db/util/sqlgen"
+	"upper.io/db/util/sqlutil"
 )
 
 // Format for saving dates.
@@ -41,145 +46,189 @@ var DateFormat = "2006-01-02 15:04:05"
 // Format for saving times.
 var TimeFormat = "%d:%02d:%02d.%d"
 
+// Default SSL mode, may be overridden by the "sslmode" option.
 var SSLMode = "disable"
 
+// Options that can be given in db.Settings.Options.
+var options = []string{
+	`sslmode`,
+	`sslcert`,
+	`sslkey`,
+	`sslrootcert`,
+	`connect_timeout`,
+	`statement_timeout`,
+}
+
+var sslModes = map[string]bool{
+	`disable`:     true,
+	`allow`:       true,
+	`prefer`:      true,
+	`require`:     true,
+	`verify-ca`:   true,
+	`verify-full`: true,
+}
+
 var columnPattern = regexp.MustCompile(`^([a-z]+)\(?([0-9,]+)?\)?\s?([a-z]*)?`)
 
-const driverName = `postgresql`
+// Statements EXPLAIN can be applied to.
+var explainPattern = regexp.MustCompile(`(?i)^\s*(SELECT|INSERT|UPDATE|DELETE)\b`)
 
-type sqlValues_t []interface{}
+// Used to generate unique savepoint names.
+var savepointSeq uint64
+
+const driverName = `postgresql`
 
 type Source struct {
 	config      db.Settings
 	session     *sql.DB
+	tx          *sql.Tx
+	begun       *Tx
+	ctx         context.Context
+	logger      db.Logger
+	slowQueries *db.SlowQueryReport
+	// Cloned sources share the session of the source they were cloned from.
+	shared      bool
 	name        string
 	collections map[string]db.Collection
 }
 
-type sqlQuery struct {
-	Query []string
-	Args  []interface{}
-}
-
-func debugEnabled() bool {
-	if os.Getenv(db.EnvEnableDebug) != "" {
-		return true
-	}
-	return false
-}
-
 func init() {
 	db.Register(driverName, &Source{})
 }
 
-func debugLogQuery(s string, q *sqlQuery) {
-	log.Printf("SQL: %s\nARGS: %v\n", strings.TrimSpace(s), q.Args)
-}
+// Sends the status of a query to the logger of this source, if any, and to the
+// slow query handler if the query was slow.
+func (self *Source) logQuery(query string, args []interface{}, start time.Time, res sql.Result, err error) {
+	elapsed := time.Since(start)
+	report := self.slowQueries
 
-func sqlCompile(terms []interface{}) *sqlQuery {
-	q := &sqlQuery{}
+	logger := self.logger
+	if logger == nil {
+		logger = db.GetLogger()
+	}
 
-	q.Query = []string{}
+	if logger == nil && report.IsSlow(elapsed) == false {
+		return
+	}
 
-	for _, term := range terms {
-		switch t := term.(type) {
-		case sqlValues_t:
-			args := make([]string, len(t))
-			for i, arg := range t {
-				args[i] = `?`
-				q.Args = append(q.Args, arg)
-			}
-			q.Query = append(q.Query, `(`+strings.Join(args, `, `)+`)`)
-		case string:
-			q.Query = append(q.Query, t)
-		default:
-			if reflect.TypeOf(t).Kind() == reflect.Slice {
-				var v = reflect.ValueOf(t)
-				for i := 0; i < v.Len(); i++ {
-					q.Args = append(q.Args, v.Index(i).Interface())
-				}
-			} else {
-				q.Args = append(q.Args, t)
-			}
+	status := &db.QueryStatus{
+		Adapter:      driverName,
+		Query:        query,
+		Args:         args,
+		Duration:     elapsed,
+		RowsAffected: -1,
+		Err:          err,
+	}
+
+	if res != nil && err == nil {
+		if n, err := res.RowsAffected(); err == nil {
+			status.RowsAffected = n
 		}
 	}
 
-	return q
-}
+	if logger != nil {
+		logger.Log(status)
+	}
 
-func sqlFields(names []string) string {
-	for i, _ := range names {
-		names[i] = strings.Replace(names[i], `"`, `\"`, -1)
+	if report.IsSlow(elapsed) {
+		slow := &db.SlowQuery{QueryStatus: *status}
+		if report.Explain && err == nil && explainPattern.MatchString(query) {
+			slow.Explain, slow.ExplainErr = self.explain(query, args)
+		}
+		report.Handler(slow)
 	}
-	return `("` + strings.Join(names, `", "`) + `")`
 }
 
-func sqlValues(values []interface{}) sqlValues_t {
-	ret := make(sqlValues_t, len(values))
-	for i, _ := range values {
-		ret[i] = values[i]
+// Returns the EXPLAIN output of a query. It runs outside of the current
+// transaction, since the transaction may have a pending result set.
+func (self *Source) explain(query string, args []interface{}) (string, error) {
+	rows, err := self.session.Query(`EXPLAIN `+query, args...)
+	if err != nil {
+		return "", err
 	}
-	return ret
+	defer rows.Close()
+	return sqlutil.ExplainRows(rows)
 }
 
-func (self *Source) doExec(terms ...interface{}) (sql.Result, error) {
+func (self *Source) doExec(stmt *sqlgen.Statement) (sql.Result, error) {
 	if self.session == nil {
 		return nil, db.ErrNotConnected
 	}
 
-	chunks := sqlCompile(terms)
+	query, args, err := stmt.Compile(dialect{})
+	if err != nil {
+		return nil, err
+	}
 
-	query := strings.Join(chunks.Query, ` `)
+	var res sql.Result
 
-	for i := 0; i < len(chunks.Args); i++ {
-		query = strings.Replace(query, `?`, fmt.Sprintf(`$%d`, i+1), 1)
-	}
+	ctx := self.context()
+	start := time.Now()
 
-	if debugEnabled() == true {
-		debugLogQuery(query, chunks)
+	if self.tx != nil {
+		res, err = self.tx.ExecContext(ctx, query, args...)
+	} else {
+		res, err = self.session.ExecContext(ctx, query, args...)
 	}
 
-	return self.session.Exec(query, chunks.Args...)
+	err = util.ContextError(ctx, err)
+	self.logQuery(query, args, start, res, err)
+
+	return res, err
 }
 
-func (self *Source) doQuery(terms ...interface{}) (*sql.Rows, error) {
+func (self *Source) doQuery(stmt *sqlgen.Statement) (*sql.Rows, error) {
 	if self.session == nil {
 		return nil, db.ErrNotConnected
 	}
 
-	chunks := sqlCompile(terms)
+	query, args, err := stmt.Compile(dialect{})
+	if err != nil {
+		return nil, err
+	}
+
+	var rows *sql.Rows
 
-	query := strings.Join(chunks.Query, ` `)
+	ctx := self.context()
+	start := time.Now()
 
-	for i := 0; i < len(chunks.Args); i++ {
-		query = strings.Replace(query, `?`, fmt.Sprintf(`$%d`, i+1), 1)
+	if self.tx != nil {
+		rows, err = self.tx.QueryContext(ctx, query, args...)
+	} else {
+		rows, err = self.session.QueryContext(ctx, query, args...)
 	}
 
-	if debugEnabled() == true {
-		debugLogQuery(query, chunks)
-	}
+	err = util.ContextError(ctx, err)
+	self.logQuery(query, args, start, nil, err)
 
-	return self.session.Query(query, chunks.Args...)
+	return rows, err
 }
 
-func (self *Source) doQueryRow(terms ...interface{}) (*sql.Row, error) {
+func (self *Source) doQueryRow(stmt *sqlgen.Statement) (*sql.Row, error) {
 	if self.session == nil {
 		return nil, db.ErrNotConnected
 	}
 
-	chunks := sqlCompile(terms)
+	query, args, err := stmt.Compile(dialect{})
+	if err != nil {
+		return nil, err
+	}
 
-	query := strings.Join(chunks.Query, ` `)
+	var row *sql.Row
 
-	for i := 0; i < len(chunks.Args); i++ {
-		query = strings.Replace(query, `?`, fmt.Sprintf(`$%d`, i+1), 1)
-	}
+	ctx := self.context()
+	start := time.Now()
 
-	if debugEnabled() == true {
-		debugLogQuery(query, chunks)
+	if self.tx != nil {
+		row = self.tx.QueryRowContext(ctx, query, args...)
+	} else {
+		row = self.session.QueryRowContext(ctx, query, args...)
 	}
 
-	return self.session.QueryRow(query, chunks.Args...), nil
+	// Errors are deferred until the row is scanned.
+	self.logQuery(query, args, start, nil, nil)
+
+	return row, nil
 }
 
 // Returns the string name of the database.
@@ -221,26 +270,114 @@ func (self *Source) Open() error {
 		return db.ErrSockerOrHost
 	}
 
-	var conn string
+	if err = util.CheckOptions(self.config.Options, options...); err != nil {
+		return err
+	}
 
+	sslMode := SSLMode
+	if v, ok := self.config.Options[`sslmode`]; ok {
+		if sslModes[v] == false {
+			return &db.OptionError{Key: `sslmode`, Value: v, Err: db.ErrInvalidOptionValue}
+		}
+		sslMode = v
+	}
+
+	host := self.config.Host
+	if host == "" {
+		host = self.config.Socket
+	}
+
+	conn := conninfo(``, `user`, self.config.User)
+	conn = conninfo(conn, `password`, self.config.Password)
+	conn = conninfo(conn, `host`, host)
 	if self.config.Host != "" {
-		conn = fmt.Sprintf(`user=%s password=%s host=%s port=%d dbname=%s sslmode=%s`, self.config.User, self.config.Password, self.config.Host, self.config.Port, self.config.Database, SSLMode)
-	} else if self.config.Socket != `` {
-		conn = fmt.Sprintf(`user=%s password=%s host=%s dbname=%s sslmode=%s`, self.config.User, self.config.Password, self.config.Socket, self.config.Database, SSLMode)
+		conn = conninfo(conn, `port`, strconv.Itoa(self.config.Port))
+	}
+	conn = conninfo(conn, `dbname`, self.config.Database)
+	conn = conninfo(conn, `sslmode`, sslMode)
+
+	for _, key := range []string{`sslcert`, `sslkey`, `sslrootcert`} {
+		if v, ok := self.config.Options[key]; ok {
+			conn = conninfo(conn, key, v)
+		}
+	}
+
+	// Timeouts are given in seconds (connect_timeout) and milliseconds
+	// (statement_timeout).
+	for _, key := range []string{`connect_timeout`, `statement_timeout`} {
+		if v, ok := self.config.Options[key]; ok {
+			if n, err := strconv.Atoi(v); err != nil || n < 0 {
+				return &db.OptionError{Key: key, Value: v, Err: db.ErrInvalidOptionValue}
+			}
+			conn = conninfo(conn, key, v)
+		}
 	}
 
 	self.session, err = sql.Open(`postgres`, conn)
+	self.shared = false
 
 	if err != nil {
 		return err
 	}
 
+	sqlutil.SetPoolLimits(self.session, self.config)
+
 	return nil
 }
 
-// Closes the current database session.
+// Appends a key='value' pair to a libpq connection string. Values are always
+// quoted, with backslashes and single quotes escaped.
+func conninfo(conn string, key string, value string) string {
+	value = strings.Replace(value, `\`, `\\`, -1)
+	value = strings.Replace(value, `'`, `\'`, -1)
+	if conn != "" {
+		conn = conn + ` `
+	}
+	return conn + key + `='` + value + `'`
+}
+
+// Clones the current database session. The clone shares the underlying
+// *sql.DB but keeps its own collection cache, so it can be handed to another
+// goroutine.
+func (self *Source) Clone() (db.Database, error) {
+	if self.session == nil {
+		return nil, db.ErrNotConnected
+	}
+	return self.clone(), nil
+}
+
+// Returns error if the database server cannot be reached.
+func (self *Source) Ping() error {
+	if self.session == nil {
+		return db.ErrNotConnected
+	}
+	return util.ContextError(self.context(), self.session.PingContext(self.context()))
+}
+
+// Returns statistics about the connection pool, which is shared with the
+// clones of this source.
+func (self *Source) Stats() db.Stats {
+	if self.session == nil {
+		return db.Stats{}
+	}
+	return sqlutil.PoolStats(self.session)
+}
+
+// Sets the logger that receives the queries of this source.
+func (self *Source) SetLogger(logger db.Logger) {
+	self.logger = logger
+}
+
+// Reports the queries of this source that are slower than the threshold of the
+// given report.
+func (self *Source) SetSlowQueryReport(report *db.SlowQueryReport) {
+	self.slowQueries = report
+}
+
+// Closes the current database session. The session of a cloned source is
+// closed by the source it was cloned from.
 func (self *Source) Close() error {
-	if self.session != nil {
+	if self.session != nil && self.shared == false {
 		return self.session.Close()
 	}
 	return nil
@@ -252,16 +389,141 @@ func (self *Source) Use(database string) error {
 	return self.Open()
 }
 
-// Starts a transaction block.
+// Starts a transaction block, the queries of this source and of its
+// collections run within it until End() is called. Begin() and End() are not
+// safe for concurrent use.
+//
+// Deprecated: Use Transaction(), which returns the transaction instead of
+// binding it to the source.
 func (self *Source) Begin() error {
-	_, err := self.session.Exec(`BEGIN`)
-	return err
+	if self.begun != nil {
+		return db.ErrTransactionInProgress
+	}
+
+	tx, err := self.Transaction()
+	if err != nil {
+		return err
+	}
+
+	self.begun = tx.(*Tx)
+	self.tx = self.begun.tx
+
+	return nil
 }
 
-// Ends a transaction block.
+// Commits the transaction block started by Begin().
+//
+// Deprecated: Use Transaction() instead.
 func (self *Source) End() error {
-	_, err := self.session.Exec(`END`)
-	return err
+	if self.begun == nil {
+		return db.ErrNoTransaction
+	}
+
+	tx := self.begun
+	self.begun = nil
+
+	if tx.savepoint == "" {
+		self.tx = nil
+	}
+
+	return tx.Commit()
+}
+
+// Returns a copy of the current source that shares its underlying session.
+func (self *Source) clone() *Source {
+	src := &Source{}
+	src.config = self.config
+	src.session = self.session
+	src.tx = self.tx
+	src.ctx = self.ctx
+	src.logger = self.logger
+	src.slowQueries = self.slowQueries
+	src.shared = true
+	src.collections = make(map[string]db.Collection)
+	return src
+}
+
+// Executes a raw SQL query and returns an iterator over the resulting rows.
+func (self *Source) Query(query string, args ...interface{}) (db.Iterator, error) {
+	rows, err := self.doQuery(sqlgen.RawQuery(query, args...))
+
+	if err != nil {
+		return nil, err
+	}
+
+	return sqlutil.NewIterator(self.context(), &sqlutil.T{}, rows), nil
+}
+
+// Executes a raw SQL statement.
+func (self *Source) Exec(query string, args ...interface{}) (db.ExecResult, error) {
+	return self.doExec(sqlgen.RawQuery(query, args...))
+}
+
+// Returns the dialect statements are compiled with.
+func (self *Source) Dialect() sqlgen.Dialect {
+	return dialect{}
+}
+
+// Executes a statement that doesn't return rows, see sqlutil.Source.
+func (self *Source) ExecStatement(stmt *sqlgen.Statement) (sql.Result, error) {
+	return self.doExec(stmt)
+}
+
+// Executes a statement that returns rows, see sqlutil.Source.
+func (self *Source) QueryStatement(stmt *sqlgen.Statement) (*sql.Rows, error) {
+	return self.doQuery(stmt)
+}
+
+// Returns the context queries run within.
+func (self *Source) Context() context.Context {
+	return self.context()
+}
+
+// Returns the context queries run within.
+func (self *Source) context() context.Context {
+	if self.ctx == nil {
+		return context.Background()
+	}
+	return self.ctx
+}
+
+// Returns a copy of the current source that runs all its queries within the
+// given context.
+func (self *Source) WithContext(ctx context.Context) db.Database {
+	clone := self.clone()
+	clone.ctx = ctx
+	return clone
+}
+
+// Starts a transaction and returns a db.Tx bound to it. Calling Transaction()
+// on a db.Tx starts a nested transaction.
+func (self *Source) Transaction() (db.Tx, error) {
+	var err error
+	var sqlTx *sql.Tx
+
+	if self.session == nil {
+		return nil, db.ErrNotConnected
+	}
+
+	if self.tx != nil {
+		// Nested transactions are backed by savepoints.
+		name := fmt.Sprintf(`upperio_sp_%d`, atomic.AddUint64(&savepointSeq, 1))
+
+		if _, err = self.doExec(sqlgen.RawQuery(`SAVEPOINT ` + name)); err != nil {
+			return nil, err
+		}
+
+		return &Tx{Source: self.clone(), savepoint: name}, nil
+	}
+
+	if sqlTx, err = self.session.BeginTx(self.context(), nil); err != nil {
+		return nil, util.ContextError(self.context(), err)
+	}
+
+	clone := self.clone()
+	clone.tx = sqlTx
+
+	return &Tx{Source: clone}, nil
 }
 
 // Drops the currently active database.
@@ -275,7 +537,7 @@ func (self *Source) Collections() ([]string, error) {
 	var collections []string
 	var collection string
 
-	rows, err := self.session.Query(`SELECT table_name FROM information_schema.tables WHERE table_schema = 'public'`)
+	rows, err := self.doQuery(sqlgen.RawQuery(`SELECT table_name FROM information_schema.tables WHERE table_schema = 'public'`))
 
 	if err != nil {
 		return nil, err
@@ -302,7 +564,8 @@ func (self *Source) Collection(name string) (db.Collection, error) {
 
 	table.source = self
 	table.DB = self
-	table.PrimaryKey = `id`
+	table.Source = self
+	table.ConvertFn = toInternal
 
 	table.SetName = name
 
@@ -312,14 +575,14 @@ func (self *Source) Collection(name string) (db.Collection, error) {
 	}
 
 	// Fetching table datatypes and mapping to internal gotypes.
-	rows, err := table.source.doQuery(
+	rows, err := table.source.doQuery(sqlgen.RawQuery(
 		`SELECT
 			column_name, data_type
 		FROM information_schema.columns
 		WHERE
 			table_name = ?`,
-		[]string{table.Name()},
-	)
+		table.Name(),
+	))
 
 	if err != nil {
 		return table, err
@@ -372,6 +635,10 @@ func (self *Source) Collection(name string) (db.Collection, error) {
 		table.ColumnTypes[column.ColumnName] = ctype
 	}
 
+	if table.PrimaryKeys, err = table.primaryKeys(); err != nil {
+		return nil, err
+	}
+
 	self.collections[name] = table
 
 	return table, nil
@@ -36,7 +36,6 @@ package postgresql
 import (
 	"database/sql"
 	"menteslibres.net/gosexy/to"
-	"os"
 	"reflect"
 	"strings"
 	"testing"
@@ -101,7 +100,7 @@ var testValues = testValuesStruct{
 // Enabling outputting some information to stdout (like the SQL query and its
 // arguments), useful for development.
 func TestEnableDebug(t *testing.T) {
-	os.Setenv(db.EnvEnableDebug, "TRUE")
+	db.SetLogger(db.StdLogger)
 }
 
 // Trying to open an empty datasource, it must fail.
@@ -113,6 +112,18 @@ func TestOpenFailed(t *testing.T) {
 	}
 }
 
+// Connection string values must be quoted and escaped.
+func TestConninfo(t *testing.T) {
+	conn := conninfo(``, `user`, `pg user`)
+	conn = conninfo(conn, `password`, `it's a \ secret host=evil`)
+
+	expected := `user='pg user' password='it\'s a \\ secret host=evil'`
+
+	if conn != expected {
+		t.Fatalf("Expecting %s, got %s.", expected, conn)
+	}
+}
+
 // Truncates all collections.
 func TestTruncate(t *testing.T) {
 
@@ -541,7 +552,7 @@ func TestFunction(t *testing.T) {
 		t.Fatalf("One: %q", err)
 	}
 
-	res = artist.Find(db.Cond{"id": db.Func{"NOT IN", []int{0, -1}}})
+	res = artist.Find(db.Cond{"id": db.Func{Name: "NOT IN", Args: []int{0, -1}}})
 
 	if err = res.One(&row_s); err != nil {
 		t.Fatalf("One: %q", err)
@@ -635,7 +646,7 @@ func TestDataTypes(t *testing.T) {
 
 // We are going to benchmark the engine, so this is no longed needed.
 func TestDisableDebug(t *testing.T) {
-	os.Setenv(db.EnvEnableDebug, "")
+	db.SetLogger(nil)
 }
 
 // Benchmarking raw database/sql.
@@ -743,3 +754,51 @@ func BenchmarkAppendStruct(b *testing.B) {
 		}
 	}
 }
+
+// Benchmarking AppendAll() with maps.
+func BenchmarkAppendAllDbItem(b *testing.B) {
+	sess, err := db.Open(wrapperName, settings)
+
+	if err != nil {
+		b.Fatalf(err.Error())
+	}
+
+	defer sess.Close()
+
+	artist, err := sess.Collection("artist")
+	artist.Truncate()
+
+	items := make([]map[string]string, b.N)
+	for i := range items {
+		items[i] = map[string]string{"name": "Leonardo DaVinci"}
+	}
+
+	b.ResetTimer()
+	if _, err = artist.AppendAll(items); err != nil {
+		b.Fatalf(err.Error())
+	}
+}
+
+// Benchmarking AppendAll() with structs.
+func BenchmarkAppendAllStruct(b *testing.B) {
+	sess, err := db.Open(wrapperName, settings)
+
+	if err != nil {
+		b.Fatalf(err.Error())
+	}
+
+	defer sess.Close()
+
+	artist, err := sess.Collection("artist")
+	artist.Truncate()
+
+	items := make([]struct{ Name string }, b.N)
+	for i := range items {
+		items[i].Name = "John Lennon"
+	}
+
+	b.ResetTimer()
+	if _, err = artist.AppendAll(items); err != nil {
+		b.Fatalf(err.Error())
+	}
+}
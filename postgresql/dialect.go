@@ -0,0 +1,102 @@
+/*
+  Copyright (c) 2012-2014 José Carlos Nieto, https://menteslibres.net/xiam
+
+  Permission is hereby granted, free of charge, to any person obtaining
+  a copy of this software and associated documentation files (the
+  "Software"), to deal in the Software without restriction, including
+  without limitation the rights to use, copy, modify, merge, publish,
+  distribute, sublicense, and/or sell copies of the Software, and to
+  permit persons to whom the Software is furnished to do so, subject to
+  the following conditions:
+
+  The above copyright notice and this permission notice shall be
+  included in all copies or substantial portions of the Software.
+
+  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+  EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+  MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+  NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+  LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+  OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+  WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+
+package postgresql
+
+import (
+	"strconv"
+	"strings"
+	"upper.io/db/util/sqlgen"
+)
+
+// PostgreSQL syntax for sqlgen.
+type dialect struct{}
+
+// PostgreSQL operators besides the standard ones.
+var operators = map[string]bool{
+	`SIMILAR TO`:     true,
+	`NOT SIMILAR TO`: true,
+	`~`:              true,
+	`~*`:             true,
+	`!~`:             true,
+	`!~*`:            true,
+}
+
+func (self dialect) QuoteIdentifier(name string) (string, bool) {
+	return `"` + strings.Replace(name, `"`, `""`, -1) + `"`, true
+}
+
+func (self dialect) Placeholder(n int) string {
+	return `$` + strconv.Itoa(n)
+}
+
+func (self dialect) Operator(op string) (string, bool) {
+	if operators[op] {
+		return op, true
+	}
+	return sqlgen.StandardOperator(op)
+}
+
+// PostgreSQL matches regular expressions with ~.
+func (self dialect) Match(column string, op string, pattern string, bind func(interface{}) string) string {
+	switch op {
+	case `REGEXP`:
+		return column + ` ~ ` + bind(pattern)
+	case `NOT REGEXP`:
+		return column + ` !~ ` + bind(pattern)
+	}
+	return column + ` ` + op + ` ` + bind(pattern)
+}
+
+func (self dialect) LimitOffset(limit int, offset int) string {
+	return sqlgen.LimitOffset(limit, offset)
+}
+
+func (self dialect) Truncate(table string) string {
+	return `TRUNCATE TABLE ` + table
+}
+
+func (self dialect) SupportsHaving() bool {
+	return true
+}
+
+func (self dialect) Join(kind string) (string, bool) {
+	return kind, true
+}
+
+func (self dialect) SupportsReturning() bool {
+	return true
+}
+
+// PostgreSQL's protocol counts arguments with 16 bits.
+func (self dialect) MaxArguments() int {
+	return 65535
+}
+
+func (self dialect) OnConflict(conflict []string, update []string) (string, bool) {
+	return sqlgen.OnConflict(conflict, update, `EXCLUDED`), true
+}
+
+func (self dialect) Value(v interface{}) interface{} {
+	return toInternal(v)
+}
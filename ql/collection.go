@@ -24,10 +24,8 @@
 package ql
 
 import (
-	"fmt"
-	"reflect"
-	"strings"
 	"upper.io/db"
+	"upper.io/db/util/sqlgen"
 	"upper.io/db/util/sqlutil"
 )
 
@@ -41,182 +39,69 @@ func mirrorFn(a interface{}) interface{} {
 	return a
 }
 
-func (self *Table) Find(terms ...interface{}) db.Result {
+// Inserts an item, or updates the rows that match the conditions if there are
+// any. QL has no upserts, so both the lookup and the write run within a
+// transaction.
+func (self *Table) Upsert(cond db.Cond, item interface{}) error {
+	fields, values, _, err := self.UpsertValues(cond, item, mirrorFn)
 
-	queryChunks := sqlutil.NewQueryChunks()
-
-	// No specific fields given.
-	if len(queryChunks.Fields) == 0 {
-		queryChunks.Fields = []string{`*`}
-	}
-
-	// Compiling conditions
-	queryChunks.Conditions, queryChunks.Arguments = self.compileConditions(terms)
-
-	if queryChunks.Conditions == "" {
-		queryChunks.Conditions = `1 == 1`
+	if err != nil {
+		return err
 	}
 
-	// Creating a result handler.
-	result := &Result{
-		self,
-		queryChunks,
-		nil,
-		&t{&self.T},
-	}
+	source := self.source
 
-	return result
-}
+	var tx db.Tx
 
-// Transforms conditions into arguments for sql.Exec/sql.Query
-func (self *Table) compileConditions(term interface{}) (string, []interface{}) {
-	sql := []string{}
-	args := []interface{}{}
-
-	switch t := term.(type) {
-	case []interface{}:
-		for i := range t {
-			rsql, rargs := self.compileConditions(t[i])
-			if rsql != "" {
-				sql = append(sql, rsql)
-				args = append(args, rargs...)
-			}
-		}
-		if len(sql) > 0 {
-			return `(` + strings.Join(sql, ` && `) + `)`, args
-		}
-	case db.Or:
-		for i := range t {
-			rsql, rargs := self.compileConditions(t[i])
-			if rsql != "" {
-				sql = append(sql, rsql)
-				args = append(args, rargs...)
-			}
-		}
-		if len(sql) > 0 {
-			return `(` + strings.Join(sql, ` || `) + `)`, args
-		}
-	case db.And:
-		for i := range t {
-			rsql, rargs := self.compileConditions(t[i])
-			if rsql != "" {
-				sql = append(sql, rsql)
-				args = append(args, rargs...)
-			}
-		}
-		if len(sql) > 0 {
-			return `(` + strings.Join(sql, ` && `) + `)`, args
+	if source.tx == nil {
+		if tx, err = source.Transaction(); err != nil {
+			return err
 		}
-	case db.Cond:
-		return self.compileStatement(t)
+		defer tx.Close()
+		source = tx.(*Tx).Source
 	}
 
-	return "", args
-}
-
-func (self *Table) compileStatement(cond db.Cond) (string, []interface{}) {
-
-	total := len(cond)
-
-	str := make([]string, 0, total)
-	arg := make([]interface{}, 0, total)
-
-	// Walking over conditions
-	for field, value := range cond {
-		// Removing leading or trailing spaces.
-		field = strings.TrimSpace(field)
-
-		chunks := strings.SplitN(field, ` `, 2)
+	table := &Table{source: source, T: self.T}
+	table.Source = source
+	table.Fetcher = fetcher{&t{&table.T}}
 
-		// Default operator.
-		op := `==`
+	var total uint64
 
-		if len(chunks) > 1 {
-			// User has defined a different operator.
-			op = chunks[1]
-		}
-
-		switch value := value.(type) {
-		case db.Func:
-			value_i := interfaceArgs(value.Args)
-			if value_i == nil {
-				str = append(str, fmt.Sprintf(`%s %s ()`, chunks[0], value.Name))
-			} else {
-				str = append(str, fmt.Sprintf(`%s %s (?%s)`, chunks[0], value.Name, strings.Repeat(`,?`, len(value_i)-1)))
-				arg = append(arg, value_i...)
-			}
-		default:
-			value_i := interfaceArgs(value)
-			if value_i == nil {
-				str = append(str, fmt.Sprintf(`%s %s ()`, chunks[0], op))
-			} else {
-				str = append(str, fmt.Sprintf(`%s %s (?%s)`, chunks[0], op, strings.Repeat(`,?`, len(value_i)-1)))
-				arg = append(arg, value_i...)
-			}
-		}
+	if total, err = table.Find(cond).Count(); err != nil {
+		return err
 	}
 
-	switch len(str) {
-	case 1:
-		return str[0], arg
-	case 0:
-		return "", []interface{}{}
+	if total > 0 {
+		err = table.Find(cond).Update(item)
+	} else {
+		_, err = source.doExec(&sqlgen.Statement{
+			Type:    sqlgen.Insert,
+			Table:   self.Name(),
+			Columns: fields,
+			Values:  values,
+		})
 	}
 
-	return `(` + strings.Join(str, ` AND `) + `)`, arg
-}
-
-// Deletes all the rows within the collection.
-func (self *Table) Truncate() (err error) {
-
-	_, err = self.source.doExec(
-		fmt.Sprintf(`TRUNCATE TABLE %s`, self.Name()),
-	)
-
-	return err
-}
-
-// Appends an item (map or struct) into the collection.
-func (self *Table) Append(item interface{}) (interface{}, error) {
-
-	fields, values, err := self.FieldValues(item, mirrorFn)
-
-	// Error ocurred, stop appending.
-	if err != nil {
-		return nil, err
-	}
-
-	res, err := self.source.doExec(
-		fmt.Sprintf(`INSERT INTO %s`, self.Name()),
-		sqlFields(fields),
-		`VALUES`,
-		sqlValues(values),
-	)
-
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	var id int64
-
-	id, err = res.LastInsertId()
-
-	if err != nil {
-		return nil, err
+	if tx != nil {
+		return tx.Commit()
 	}
 
-	return id, nil
+	return nil
 }
 
 // Returns true if the collection exists.
 func (self *Table) Exists() bool {
-	rows, err := self.source.doQuery(
+	rows, err := self.source.doQuery(sqlgen.RawQuery(
 		`SELECT Name
 			FROM __Table
 		WHERE Name == ?
 		`,
-		[]interface{}{self.Name()},
-	)
+		self.Name(),
+	))
 
 	if err != nil {
 		return false
@@ -226,34 +111,3 @@ func (self *Table) Exists() bool {
 
 	return rows.Next()
 }
-
-func interfaceArgs(value interface{}) (args []interface{}) {
-
-	if value == nil {
-		return nil
-	}
-
-	value_v := reflect.ValueOf(value)
-
-	switch value_v.Type().Kind() {
-	case reflect.Slice:
-		var i, total int
-
-		total = value_v.Len()
-		if total > 0 {
-			args = make([]interface{}, total)
-
-			for i = 0; i < total; i++ {
-				args[i] = value_v.Index(i).Interface()
-			}
-
-			return args
-		} else {
-			return nil
-		}
-	default:
-		args = []interface{}{value}
-	}
-
-	return args
-}
@@ -24,19 +24,19 @@
 package ql
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	_ "github.com/cznic/ql/driver"
-	"log"
-	"os"
 	"reflect"
 	"strings"
 	"time"
 	"upper.io/db"
+	"upper.io/db/util"
+	"upper.io/db/util/sqlgen"
+	"upper.io/db/util/sqlutil"
 )
 
-var Debug = false
-
 // Format for saving dates.
 var DateFormat = "2006-01-02 15:04:05"
 
@@ -47,151 +47,157 @@ var timeType = reflect.TypeOf(time.Time{}).Kind()
 
 const driverName = `ql`
 
-type sqlValues_t []interface{}
-
 type Source struct {
 	config      db.Settings
 	session     *sql.DB
+	tx          *sql.Tx
+	begun       *Tx
+	ctx         context.Context
+	logger      db.Logger
+	slowQueries *db.SlowQueryReport
+	// Cloned sources share the session of the source they were cloned from.
+	shared      bool
 	name        string
 	collections map[string]db.Collection
 }
 
-type sqlQuery struct {
-	Query []string
-	Args  []interface{}
-}
-
-func debugEnabled() bool {
-	if os.Getenv(db.EnvEnableDebug) != "" {
-		return true
-	}
-	return false
-}
-
 func init() {
 	db.Register(driverName, &Source{})
 }
 
-func debugLogQuery(s string, q *sqlQuery) {
-	log.Printf("SQL: %s\nARGS: %v\n", strings.TrimSpace(s), q.Args)
-}
+// Sends the status of a query to the logger of this source, if any, and to the
+// slow query handler if the query was slow.
+func (self *Source) logQuery(query string, args []interface{}, start time.Time, res sql.Result, err error) {
+	elapsed := time.Since(start)
+	report := self.slowQueries
 
-func sqlCompile(terms []interface{}) *sqlQuery {
-	q := &sqlQuery{}
+	logger := self.logger
+	if logger == nil {
+		logger = db.GetLogger()
+	}
 
-	q.Query = []string{}
+	if logger == nil && report.IsSlow(elapsed) == false {
+		return
+	}
 
-	for _, term := range terms {
-		switch t := term.(type) {
-		case sqlValues_t:
-			args := make([]string, len(t))
-			for i, arg := range t {
-				args[i] = `?`
-				q.Args = append(q.Args, arg)
-			}
-			q.Query = append(q.Query, `(`+strings.Join(args, `, `)+`)`)
-		case string:
-			q.Query = append(q.Query, t)
-		default:
-			if reflect.TypeOf(t).Kind() == reflect.Slice {
-				var v = reflect.ValueOf(t)
-				for i := 0; i < v.Len(); i++ {
-					q.Args = append(q.Args, v.Index(i).Interface())
-				}
-			} else {
-				q.Args = append(q.Args, t)
-			}
-		}
+	status := &db.QueryStatus{
+		Adapter:      driverName,
+		Query:        query,
+		Args:         args,
+		Duration:     elapsed,
+		RowsAffected: -1,
+		Err:          err,
 	}
 
-	return q
-}
+	if res != nil && err == nil {
+		if n, err := res.RowsAffected(); err == nil {
+			status.RowsAffected = n
+		}
+	}
 
-func sqlFields(names []string) string {
-	return `(` + strings.Join(names, `, `) + `)`
-}
+	if logger != nil {
+		logger.Log(status)
+	}
 
-func sqlValues(values []interface{}) sqlValues_t {
-	ret := make(sqlValues_t, len(values))
-	for i, _ := range values {
-		ret[i] = values[i]
+	if report.IsSlow(elapsed) {
+		slow := &db.SlowQuery{QueryStatus: *status}
+		// EXPLAIN output is not captured by this adapter.
+		report.Handler(slow)
 	}
-	return ret
 }
 
-func (self *Source) doExec(terms ...interface{}) (res sql.Result, err error) {
+func (self *Source) doExec(stmt *sqlgen.Statement) (res sql.Result, err error) {
 	var tx *sql.Tx
 
 	if self.session == nil {
 		return nil, db.ErrNotConnected
 	}
 
-	chunks := sqlCompile(terms)
+	query, args, err := stmt.Compile(dialect{})
+	if err != nil {
+		return nil, err
+	}
 
-	query := strings.Join(chunks.Query, ` `)
+	ctx := self.context()
+	start := time.Now()
 
-	for i := 0; i < len(chunks.Args); i++ {
-		query = strings.Replace(query, `?`, fmt.Sprintf(`$%d`, i+1), 1)
-	}
+	defer func() {
+		self.logQuery(query, args, start, res, err)
+	}()
 
-	if debugEnabled() == true {
-		debugLogQuery(query, chunks)
+	if self.tx != nil {
+		// QL writes happen within the current transaction.
+		res, err = self.tx.ExecContext(ctx, query, args...)
+		return res, util.ContextError(ctx, err)
 	}
 
-	if tx, err = self.session.Begin(); err != nil {
-		return nil, err
+	if tx, err = self.session.BeginTx(ctx, nil); err != nil {
+		return nil, util.ContextError(ctx, err)
 	}
 
-	if res, err = tx.Exec(query, chunks.Args...); err != nil {
-		return nil, err
+	if res, err = tx.ExecContext(ctx, query, args...); err != nil {
+		return nil, util.ContextError(ctx, err)
 	}
 
 	if err = tx.Commit(); err != nil {
-		return nil, err
+		return nil, util.ContextError(ctx, err)
 	}
 
 	return res, nil
 }
 
-func (self *Source) doQuery(terms ...interface{}) (*sql.Rows, error) {
+func (self *Source) doQuery(stmt *sqlgen.Statement) (*sql.Rows, error) {
 	if self.session == nil {
 		return nil, db.ErrNotConnected
 	}
 
-	chunks := sqlCompile(terms)
+	query, args, err := stmt.Compile(dialect{})
+	if err != nil {
+		return nil, err
+	}
+
+	var rows *sql.Rows
 
-	query := strings.Join(chunks.Query, ` `)
+	ctx := self.context()
+	start := time.Now()
 
-	for i := 0; i < len(chunks.Args); i++ {
-		query = strings.Replace(query, `?`, fmt.Sprintf(`$%d`, i+1), 1)
+	if self.tx != nil {
+		rows, err = self.tx.QueryContext(ctx, query, args...)
+	} else {
+		rows, err = self.session.QueryContext(ctx, query, args...)
 	}
 
-	if debugEnabled() == true {
-		debugLogQuery(query, chunks)
-	}
+	err = util.ContextError(ctx, err)
+	self.logQuery(query, args, start, nil, err)
 
-	return self.session.Query(query, chunks.Args...)
+	return rows, err
 }
 
-func (self *Source) doQueryRow(terms ...interface{}) (*sql.Row, error) {
+func (self *Source) doQueryRow(stmt *sqlgen.Statement) (*sql.Row, error) {
 	if self.session == nil {
 		return nil, db.ErrNotConnected
 	}
 
-	chunks := sqlCompile(terms)
+	query, args, err := stmt.Compile(dialect{})
+	if err != nil {
+		return nil, err
+	}
 
-	query := strings.Join(chunks.Query, ` `)
+	var row *sql.Row
 
-	for i := 0; i < len(chunks.Args); i++ {
-		query = strings.Replace(query, `?`, fmt.Sprintf(`$%d`, i+1), 1)
-	}
+	ctx := self.context()
+	start := time.Now()
 
-	if Debug == true {
-		fmt.Printf("Q: %s\n", query)
-		fmt.Printf("A: %v\n", chunks.Args)
+	if self.tx != nil {
+		row = self.tx.QueryRowContext(ctx, query, args...)
+	} else {
+		row = self.session.QueryRowContext(ctx, query, args...)
 	}
 
-	return self.session.QueryRow(query, chunks.Args...), nil
+	// Errors are deferred until the row is scanned.
+	self.logQuery(query, args, start, nil, nil)
+
+	return row, nil
 }
 
 // Returns the string name of the database.
@@ -219,18 +225,65 @@ func (self *Source) Open() error {
 		return db.ErrMissingDatabaseName
 	}
 
+	// The ql driver takes no options.
+	if err = util.CheckOptions(self.config.Options); err != nil {
+		return err
+	}
+
 	self.session, err = sql.Open(`ql`, self.config.Database)
+	self.shared = false
 
 	if err != nil {
 		return err
 	}
 
+	sqlutil.SetPoolLimits(self.session, self.config)
+
 	return nil
 }
 
-// Closes the current database session.
+// Clones the current database session. The clone shares the underlying
+// *sql.DB but keeps its own collection cache, so it can be handed to another
+// goroutine.
+func (self *Source) Clone() (db.Database, error) {
+	if self.session == nil {
+		return nil, db.ErrNotConnected
+	}
+	return self.clone(), nil
+}
+
+// Returns error if the database server cannot be reached.
+func (self *Source) Ping() error {
+	if self.session == nil {
+		return db.ErrNotConnected
+	}
+	return util.ContextError(self.context(), self.session.PingContext(self.context()))
+}
+
+// Returns statistics about the connection pool, which is shared with the
+// clones of this source.
+func (self *Source) Stats() db.Stats {
+	if self.session == nil {
+		return db.Stats{}
+	}
+	return sqlutil.PoolStats(self.session)
+}
+
+// Sets the logger that receives the queries of this source.
+func (self *Source) SetLogger(logger db.Logger) {
+	self.logger = logger
+}
+
+// Reports the queries of this source that are slower than the threshold of the
+// given report.
+func (self *Source) SetSlowQueryReport(report *db.SlowQueryReport) {
+	self.slowQueries = report
+}
+
+// Closes the current database session. The session of a cloned source is
+// closed by the source it was cloned from.
 func (self *Source) Close() error {
-	if self.session != nil {
+	if self.session != nil && self.shared == false {
 		return self.session.Close()
 	}
 	return nil
@@ -242,16 +295,131 @@ func (self *Source) Use(database string) error {
 	return self.Open()
 }
 
-// Starts a transaction block.
+// Starts a transaction block, the queries of this source and of its
+// collections run within it until End() is called. Begin() and End() are not
+// safe for concurrent use.
+//
+// Deprecated: Use Transaction(), which returns the transaction instead of
+// binding it to the source.
 func (self *Source) Begin() error {
-	_, err := self.session.Exec(`BEGIN`)
-	return err
+	if self.begun != nil {
+		return db.ErrTransactionInProgress
+	}
+
+	tx, err := self.Transaction()
+	if err != nil {
+		return err
+	}
+
+	self.begun = tx.(*Tx)
+	self.tx = self.begun.tx
+
+	return nil
 }
 
-// Ends a transaction block.
+// Commits the transaction block started by Begin().
+//
+// Deprecated: Use Transaction() instead.
 func (self *Source) End() error {
-	_, err := self.session.Exec(`END`)
-	return err
+	if self.begun == nil {
+		return db.ErrNoTransaction
+	}
+
+	tx := self.begun
+	self.begun = nil
+	self.tx = nil
+
+	return tx.Commit()
+}
+
+// Returns a copy of the current source that shares its underlying session.
+func (self *Source) clone() *Source {
+	src := &Source{}
+	src.config = self.config
+	src.session = self.session
+	src.tx = self.tx
+	src.ctx = self.ctx
+	src.logger = self.logger
+	src.slowQueries = self.slowQueries
+	src.shared = true
+	src.collections = make(map[string]db.Collection)
+	return src
+}
+
+// Executes a raw SQL query and returns an iterator over the resulting rows.
+func (self *Source) Query(query string, args ...interface{}) (db.Iterator, error) {
+	rows, err := self.doQuery(sqlgen.RawQuery(query, args...))
+
+	if err != nil {
+		return nil, err
+	}
+
+	return sqlutil.NewIterator(self.context(), fetcher{&t{&sqlutil.T{}}}, rows), nil
+}
+
+// Executes a raw SQL statement.
+func (self *Source) Exec(query string, args ...interface{}) (db.ExecResult, error) {
+	return self.doExec(sqlgen.RawQuery(query, args...))
+}
+
+// Returns the dialect statements are compiled with.
+func (self *Source) Dialect() sqlgen.Dialect {
+	return dialect{}
+}
+
+// Executes a statement that doesn't return rows, see sqlutil.Source.
+func (self *Source) ExecStatement(stmt *sqlgen.Statement) (sql.Result, error) {
+	return self.doExec(stmt)
+}
+
+// Executes a statement that returns rows, see sqlutil.Source.
+func (self *Source) QueryStatement(stmt *sqlgen.Statement) (*sql.Rows, error) {
+	return self.doQuery(stmt)
+}
+
+// Returns the context queries run within.
+func (self *Source) Context() context.Context {
+	return self.context()
+}
+
+// Returns the context queries run within.
+func (self *Source) context() context.Context {
+	if self.ctx == nil {
+		return context.Background()
+	}
+	return self.ctx
+}
+
+// Returns a copy of the current source that runs all its queries within the
+// given context.
+func (self *Source) WithContext(ctx context.Context) db.Database {
+	clone := self.clone()
+	clone.ctx = ctx
+	return clone
+}
+
+// Starts a transaction and returns a db.Tx bound to it.
+func (self *Source) Transaction() (db.Tx, error) {
+	var err error
+	var sqlTx *sql.Tx
+
+	if self.session == nil {
+		return nil, db.ErrNotConnected
+	}
+
+	if self.tx != nil {
+		// QL does not support savepoints.
+		return nil, db.ErrFeatureNotSupported
+	}
+
+	if sqlTx, err = self.session.BeginTx(self.context(), nil); err != nil {
+		return nil, util.ContextError(self.context(), err)
+	}
+
+	clone := self.clone()
+	clone.tx = sqlTx
+
+	return &Tx{Source: clone}, nil
 }
 
 // Drops the currently active database.
@@ -265,7 +433,7 @@ func (self *Source) Collections() ([]string, error) {
 	var collections []string
 	var collection string
 
-	rows, err := self.session.Query(`SELECT Name FROM __Table`)
+	rows, err := self.doQuery(sqlgen.RawQuery(`SELECT Name FROM __Table`))
 
 	if err != nil {
 		return nil, err
@@ -300,7 +468,13 @@ func (self *Source) Collection(name string) (db.Collection, error) {
 
 	table.source = self
 	table.DB = self
-	table.PrimaryKey = `id`
+	table.Source = self
+	table.ConvertFn = mirrorFn
+	table.Fetcher = fetcher{&t{&table.T}}
+	// QL has a single writer.
+	table.ConsecutiveIDs = true
+	// Every QL table is keyed by the id() of its records.
+	table.PrimaryKeys = []string{`id()`}
 
 	table.SetName = name
 
@@ -310,14 +484,14 @@ func (self *Source) Collection(name string) (db.Collection, error) {
 	}
 
 	// Fetching table datatypes and mapping to internal gotypes.
-	rows, err := table.source.doQuery(
+	rows, err := table.source.doQuery(sqlgen.RawQuery(
 		`SELECT
 			Name, Type
 		FROM __Column
 		WHERE
 			TableName == ?`,
-		[]string{table.Name()},
-	)
+		table.Name(),
+	))
 
 	if err != nil {
 		return table, err
@@ -0,0 +1,127 @@
+/*
+  Copyright (c) 2014 José Carlos Nieto, https://menteslibres.net/xiam
+
+  Permission is hereby granted, free of charge, to any person obtaining
+  a copy of this software and associated documentation files (the
+  "Software"), to deal in the Software without restriction, including
+  without limitation the rights to use, copy, modify, merge, publish,
+  distribute, sublicense, and/or sell copies of the Software, and to
+  permit persons to whom the Software is furnished to do so, subject to
+  the following conditions:
+
+  The above copyright notice and this permission notice shall be
+  included in all copies or substantial portions of the Software.
+
+  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+  EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+  MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+  NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+  LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+  OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+  WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+
+package ql
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"upper.io/db/util"
+	"upper.io/db/util/sqlgen"
+)
+
+// QL syntax for sqlgen.
+type dialect struct{}
+
+// QL identifiers, including the id() function.
+var identifierPattern = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*(\(\))?$`)
+
+// QL operators, standard operators that QL writes differently are mapped to
+// QL's.
+var operators = map[string]string{
+	`=`:      `==`,
+	`==`:     `==`,
+	`!=`:     `!=`,
+	`<`:      `<`,
+	`<=`:     `<=`,
+	`>`:      `>`,
+	`>=`:     `>=`,
+	`IS`:     `IS`,
+	`IS NOT`: `IS NOT`,
+	`AND`:    `&&`,
+	`OR`:     `||`,
+	`NOT`:    `!`,
+}
+
+// QL identifiers can't be quoted, so they must be valid as they are.
+func (self dialect) QuoteIdentifier(name string) (string, bool) {
+	return name, identifierPattern.MatchString(name)
+}
+
+func (self dialect) Placeholder(n int) string {
+	return `$` + strconv.Itoa(n)
+}
+
+// QL uses Go operators.
+func (self dialect) Operator(op string) (string, bool) {
+	translated, ok := operators[op]
+	return translated, ok
+}
+
+// QL's LIKE matches regular expressions, so LIKE patterns are rewritten as
+// regular expressions.
+func (self dialect) Match(column string, op string, pattern string, bind func(interface{}) string) string {
+	negated := strings.HasPrefix(op, `NOT `)
+
+	switch strings.TrimPrefix(op, `NOT `) {
+	case `LIKE`:
+		pattern = util.LikeToRegexp(pattern)
+	case `ILIKE`:
+		pattern = `(?i)` + util.LikeToRegexp(pattern)
+	}
+
+	if negated {
+		return `!(` + column + ` LIKE ` + bind(pattern) + `)`
+	}
+
+	return column + ` LIKE ` + bind(pattern)
+}
+
+func (self dialect) LimitOffset(limit int, offset int) string {
+	return sqlgen.LimitOffset(limit, offset)
+}
+
+func (self dialect) Truncate(table string) string {
+	return `TRUNCATE TABLE ` + table
+}
+
+// QL can group rows but can't filter groups.
+func (self dialect) SupportsHaving() bool {
+	return false
+}
+
+// QL has outer joins only and can't alias columns with the table prefixes
+// joined rows are decoded by, so the adapter doesn't build joins.
+func (self dialect) Join(kind string) (string, bool) {
+	return "", false
+}
+
+func (self dialect) SupportsReturning() bool {
+	return false
+}
+
+// QL has no limit on the number of arguments.
+func (self dialect) MaxArguments() int {
+	return 0
+}
+
+// QL has no upserts, the adapter runs them within a transaction instead.
+func (self dialect) OnConflict(conflict []string, update []string) (string, bool) {
+	return "", false
+}
+
+// QL values are passed as is.
+func (self dialect) Value(v interface{}) interface{} {
+	return v
+}
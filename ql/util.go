@@ -37,6 +37,19 @@ type t struct {
 	*sqlutil.T
 }
 
+// Adapts qlFetchRow() and qlFetchRows() to the sqlutil.Fetcher interface.
+type fetcher struct {
+	*t
+}
+
+func (self fetcher) FetchRow(dst interface{}, rows *sql.Rows) error {
+	return self.qlFetchRow(dst, rows)
+}
+
+func (self fetcher) FetchRows(dst interface{}, rows *sql.Rows) error {
+	return self.qlFetchRows(dst, rows)
+}
+
 func (self *t) qlFetchRow(dst interface{}, rows *sql.Rows) error {
 
 	dstv := reflect.ValueOf(dst)
@@ -173,6 +186,10 @@ func (self *t) qlFetchRows(dst interface{}, rows *sql.Rows) error {
 
 	rows.Close()
 
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
 	dstv.Elem().Set(slicev)
 
 	return nil
@@ -24,20 +24,36 @@
 package sqlite
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	// This hack is not required anymore.
 	// See: https://github.com/mattn/go-sqlite3/issues/40
 	//_ "github.com/xiam/gosqlite3"
-	_ "github.com/mattn/go-sqlite3"
-	"log"
-	"os"
+	"github.com/mattn/go-sqlite3"
 	"reflect"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 	"upper.io/db"
+	"upper.io/db/util"
+	"upper.io/db/util/sqlgen"
+	"upper.io/db/util/sqlutil"
 )
 
+// Values accepted by the journal_mode option.
+var journalModes = map[string]bool{
+	`DELETE`:   true,
+	`TRUNCATE`: true,
+	`PERSIST`:  true,
+	`MEMORY`:   true,
+	`WAL`:      true,
+	`OFF`:      true,
+}
+
 // Format for saving dates.
 var DateFormat = `2006-01-02 15:04:05`
 
@@ -46,114 +62,179 @@ var TimeFormat = `%d:%02d:%02d.%d`
 
 var columnPattern = regexp.MustCompile(`^([a-zA-Z]+)\(?([0-9,]+)?\)?\s?([a-zA-Z]*)?`)
 
+// Used to generate unique savepoint names.
+var savepointSeq uint64
+
+// Patterns compiled by the REGEXP operator, the cache is emptied when it holds
+// maxRegexps patterns.
+var (
+	regexps   = make(map[string]*regexp.Regexp)
+	regexpsMu sync.RWMutex
+)
+
+const maxRegexps = 256
+
 const driverName = `sqlite`
 
-type sqlValues_t []interface{}
+// Name of the go-sqlite3 driver with the functions this adapter needs.
+const sqlDriverName = `sqlite3_upperio`
 
 type Source struct {
 	config      db.Settings
 	session     *sql.DB
+	tx          *sql.Tx
+	begun       *Tx
+	ctx         context.Context
+	logger      db.Logger
+	slowQueries *db.SlowQueryReport
+	// Cloned sources share the session of the source they were cloned from.
+	shared      bool
 	name        string
 	collections map[string]db.Collection
 }
 
-type sqlQuery struct {
-	Query []string
-	Args  []interface{}
-}
-
-func debugEnabled() bool {
-	if os.Getenv(db.EnvEnableDebug) != "" {
-		return true
-	}
-	return false
-}
-
 func init() {
 	db.Register(driverName, &Source{})
-}
 
-func debugLogQuery(s string, q *sqlQuery) {
-	log.Printf("SQL: %s\nARGS: %v\n", strings.TrimSpace(s), q.Args)
+	// SQLite has a REGEXP operator but no function to back it.
+	sql.Register(sqlDriverName, &sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			return conn.RegisterFunc(`regexp`, regexpMatch, true)
+		},
+	})
 }
 
-func sqlCompile(terms []interface{}) *sqlQuery {
-	q := &sqlQuery{}
+// Implements the REGEXP operator. NULL never matches, numbers and blobs are
+// matched by their text.
+func regexpMatch(expr string, value interface{}) (bool, error) {
+	var s string
+
+	switch v := value.(type) {
+	case nil:
+		return false, nil
+	case string:
+		s = v
+	case []byte:
+		s = string(v)
+	default:
+		s = fmt.Sprint(v)
+	}
 
-	q.Query = []string{}
+	regexpsMu.RLock()
+	re, ok := regexps[expr]
+	regexpsMu.RUnlock()
 
-	for _, term := range terms {
-		switch t := term.(type) {
-		case sqlValues_t:
-			args := make([]string, len(t))
-			for i, arg := range t {
-				args[i] = `?`
-				q.Args = append(q.Args, arg)
-			}
-			q.Query = append(q.Query, `(`+strings.Join(args, `, `)+`)`)
-		case string:
-			q.Query = append(q.Query, t)
-		default:
-			if reflect.TypeOf(t).Kind() == reflect.Slice {
-				var v = reflect.ValueOf(t)
-				for i := 0; i < v.Len(); i++ {
-					q.Args = append(q.Args, v.Index(i).Interface())
-				}
-			} else {
-				q.Args = append(q.Args, t)
-			}
+	if ok == false {
+		var err error
+		if re, err = regexp.Compile(expr); err != nil {
+			return false, err
 		}
+
+		regexpsMu.Lock()
+		if len(regexps) >= maxRegexps {
+			regexps = make(map[string]*regexp.Regexp)
+		}
+		regexps[expr] = re
+		regexpsMu.Unlock()
 	}
 
-	return q
+	return re.MatchString(s), nil
 }
 
-func sqlFields(names []string) string {
-	for i, _ := range names {
-		names[i] = strings.Replace(names[i], `"`, `\"`, -1)
+// Sends the status of a query to the logger of this source, if any, and to the
+// slow query handler if the query was slow.
+func (self *Source) logQuery(query string, args []interface{}, start time.Time, res sql.Result, err error) {
+	elapsed := time.Since(start)
+	report := self.slowQueries
+
+	logger := self.logger
+	if logger == nil {
+		logger = db.GetLogger()
 	}
-	return `("` + strings.Join(names, `", "`) + `")`
-}
 
-func sqlValues(values []interface{}) sqlValues_t {
-	ret := make(sqlValues_t, len(values))
-	for i, _ := range values {
-		ret[i] = values[i]
+	if logger == nil && report.IsSlow(elapsed) == false {
+		return
+	}
+
+	status := &db.QueryStatus{
+		Adapter:      driverName,
+		Query:        query,
+		Args:         args,
+		Duration:     elapsed,
+		RowsAffected: -1,
+		Err:          err,
+	}
+
+	if res != nil && err == nil {
+		if n, err := res.RowsAffected(); err == nil {
+			status.RowsAffected = n
+		}
+	}
+
+	if logger != nil {
+		logger.Log(status)
+	}
+
+	if report.IsSlow(elapsed) {
+		slow := &db.SlowQuery{QueryStatus: *status}
+		// EXPLAIN output is not captured by this adapter.
+		report.Handler(slow)
 	}
-	return ret
 }
 
-func (self *Source) doExec(terms ...interface{}) (sql.Result, error) {
+func (self *Source) doExec(stmt *sqlgen.Statement) (sql.Result, error) {
 	if self.session == nil {
 		return nil, db.ErrNotConnected
 	}
 
-	chunks := sqlCompile(terms)
+	query, args, err := stmt.Compile(dialect{})
+	if err != nil {
+		return nil, err
+	}
+
+	var res sql.Result
 
-	query := strings.Join(chunks.Query, ` `)
+	ctx := self.context()
+	start := time.Now()
 
-	if debugEnabled() == true {
-		debugLogQuery(query, chunks)
+	if self.tx != nil {
+		res, err = self.tx.ExecContext(ctx, query, args...)
+	} else {
+		res, err = self.session.ExecContext(ctx, query, args...)
 	}
 
-	return self.session.Exec(query, chunks.Args...)
+	err = util.ContextError(ctx, err)
+	self.logQuery(query, args, start, res, err)
+
+	return res, err
 }
 
-func (self *Source) doQuery(terms ...interface{}) (*sql.Rows, error) {
+func (self *Source) doQuery(stmt *sqlgen.Statement) (*sql.Rows, error) {
 
 	if self.session == nil {
 		return nil, db.ErrNotConnected
 	}
 
-	chunks := sqlCompile(terms)
+	query, args, err := stmt.Compile(dialect{})
+	if err != nil {
+		return nil, err
+	}
+
+	var rows *sql.Rows
 
-	query := strings.Join(chunks.Query, ` `)
+	ctx := self.context()
+	start := time.Now()
 
-	if debugEnabled() == true {
-		debugLogQuery(query, chunks)
+	if self.tx != nil {
+		rows, err = self.tx.QueryContext(ctx, query, args...)
+	} else {
+		rows, err = self.session.QueryContext(ctx, query, args...)
 	}
 
-	return self.session.Query(query, chunks.Args...)
+	err = util.ContextError(ctx, err)
+	self.logQuery(query, args, start, nil, err)
+
+	return rows, err
 }
 
 // Returns the string name of the database.
@@ -181,18 +262,81 @@ func (self *Source) Open() error {
 		return db.ErrMissingDatabaseName
 	}
 
-	self.session, err = sql.Open(`sqlite3`, fmt.Sprintf(`file:%s?cache=shared`, self.config.Database))
+	if err = util.CheckOptions(self.config.Options, `journal_mode`, `busy_timeout`); err != nil {
+		return err
+	}
+
+	conn := fmt.Sprintf(`file:%s?cache=shared`, self.config.Database)
+
+	if v, ok := self.config.Options[`journal_mode`]; ok {
+		if journalModes[strings.ToUpper(v)] == false {
+			return &db.OptionError{Key: `journal_mode`, Value: v, Err: db.ErrInvalidOptionValue}
+		}
+		conn = conn + `&_journal_mode=` + strings.ToUpper(v)
+	}
+
+	// Milliseconds to wait for a locked database before giving up.
+	if v, ok := self.config.Options[`busy_timeout`]; ok {
+		if n, err := strconv.Atoi(v); err != nil || n < 0 {
+			return &db.OptionError{Key: `busy_timeout`, Value: v, Err: db.ErrInvalidOptionValue}
+		}
+		conn = conn + `&_busy_timeout=` + v
+	}
+
+	self.session, err = sql.Open(sqlDriverName, conn)
+	self.shared = false
 
 	if err != nil {
 		return err
 	}
 
+	sqlutil.SetPoolLimits(self.session, self.config)
+
 	return nil
 }
 
-// Closes the current database session.
+// Clones the current database session. The clone shares the underlying
+// *sql.DB but keeps its own collection cache, so it can be handed to another
+// goroutine.
+func (self *Source) Clone() (db.Database, error) {
+	if self.session == nil {
+		return nil, db.ErrNotConnected
+	}
+	return self.clone(), nil
+}
+
+// Returns error if the database server cannot be reached.
+func (self *Source) Ping() error {
+	if self.session == nil {
+		return db.ErrNotConnected
+	}
+	return util.ContextError(self.context(), self.session.PingContext(self.context()))
+}
+
+// Returns statistics about the connection pool, which is shared with the
+// clones of this source.
+func (self *Source) Stats() db.Stats {
+	if self.session == nil {
+		return db.Stats{}
+	}
+	return sqlutil.PoolStats(self.session)
+}
+
+// Sets the logger that receives the queries of this source.
+func (self *Source) SetLogger(logger db.Logger) {
+	self.logger = logger
+}
+
+// Reports the queries of this source that are slower than the threshold of the
+// given report.
+func (self *Source) SetSlowQueryReport(report *db.SlowQueryReport) {
+	self.slowQueries = report
+}
+
+// Closes the current database session. The session of a cloned source is
+// closed by the source it was cloned from.
 func (self *Source) Close() error {
-	if self.session != nil {
+	if self.session != nil && self.shared == false {
 		return self.session.Close()
 	}
 	return nil
@@ -204,16 +348,141 @@ func (self *Source) Use(database string) error {
 	return self.Open()
 }
 
-// Starts a transaction block.
+// Starts a transaction block, the queries of this source and of its
+// collections run within it until End() is called. Begin() and End() are not
+// safe for concurrent use.
+//
+// Deprecated: Use Transaction(), which returns the transaction instead of
+// binding it to the source.
 func (self *Source) Begin() error {
-	_, err := self.session.Exec(`BEGIN`)
-	return err
+	if self.begun != nil {
+		return db.ErrTransactionInProgress
+	}
+
+	tx, err := self.Transaction()
+	if err != nil {
+		return err
+	}
+
+	self.begun = tx.(*Tx)
+	self.tx = self.begun.tx
+
+	return nil
 }
 
-// Ends a transaction block.
+// Commits the transaction block started by Begin().
+//
+// Deprecated: Use Transaction() instead.
 func (self *Source) End() error {
-	_, err := self.session.Exec(`END`)
-	return err
+	if self.begun == nil {
+		return db.ErrNoTransaction
+	}
+
+	tx := self.begun
+	self.begun = nil
+
+	if tx.savepoint == "" {
+		self.tx = nil
+	}
+
+	return tx.Commit()
+}
+
+// Returns a copy of the current source that shares its underlying session.
+func (self *Source) clone() *Source {
+	src := &Source{}
+	src.config = self.config
+	src.session = self.session
+	src.tx = self.tx
+	src.ctx = self.ctx
+	src.logger = self.logger
+	src.slowQueries = self.slowQueries
+	src.shared = true
+	src.collections = make(map[string]db.Collection)
+	return src
+}
+
+// Executes a raw SQL query and returns an iterator over the resulting rows.
+func (self *Source) Query(query string, args ...interface{}) (db.Iterator, error) {
+	rows, err := self.doQuery(sqlgen.RawQuery(query, args...))
+
+	if err != nil {
+		return nil, err
+	}
+
+	return sqlutil.NewIterator(self.context(), &sqlutil.T{}, rows), nil
+}
+
+// Executes a raw SQL statement.
+func (self *Source) Exec(query string, args ...interface{}) (db.ExecResult, error) {
+	return self.doExec(sqlgen.RawQuery(query, args...))
+}
+
+// Returns the dialect statements are compiled with.
+func (self *Source) Dialect() sqlgen.Dialect {
+	return dialect{}
+}
+
+// Executes a statement that doesn't return rows, see sqlutil.Source.
+func (self *Source) ExecStatement(stmt *sqlgen.Statement) (sql.Result, error) {
+	return self.doExec(stmt)
+}
+
+// Executes a statement that returns rows, see sqlutil.Source.
+func (self *Source) QueryStatement(stmt *sqlgen.Statement) (*sql.Rows, error) {
+	return self.doQuery(stmt)
+}
+
+// Returns the context queries run within.
+func (self *Source) Context() context.Context {
+	return self.context()
+}
+
+// Returns the context queries run within.
+func (self *Source) context() context.Context {
+	if self.ctx == nil {
+		return context.Background()
+	}
+	return self.ctx
+}
+
+// Returns a copy of the current source that runs all its queries within the
+// given context.
+func (self *Source) WithContext(ctx context.Context) db.Database {
+	clone := self.clone()
+	clone.ctx = ctx
+	return clone
+}
+
+// Starts a transaction and returns a db.Tx bound to it. Calling Transaction()
+// on a db.Tx starts a nested transaction.
+func (self *Source) Transaction() (db.Tx, error) {
+	var err error
+	var sqlTx *sql.Tx
+
+	if self.session == nil {
+		return nil, db.ErrNotConnected
+	}
+
+	if self.tx != nil {
+		// Nested transactions are backed by savepoints.
+		name := fmt.Sprintf(`upperio_sp_%d`, atomic.AddUint64(&savepointSeq, 1))
+
+		if _, err = self.doExec(sqlgen.RawQuery(`SAVEPOINT ` + name)); err != nil {
+			return nil, err
+		}
+
+		return &Tx{Source: self.clone(), savepoint: name}, nil
+	}
+
+	if sqlTx, err = self.session.BeginTx(self.context(), nil); err != nil {
+		return nil, util.ContextError(self.context(), err)
+	}
+
+	clone := self.clone()
+	clone.tx = sqlTx
+
+	return &Tx{Source: clone}, nil
 }
 
 // Drops the currently active database.
@@ -227,7 +496,7 @@ func (self *Source) Collections() ([]string, error) {
 	var collections []string
 	var collection string
 
-	rows, err := self.session.Query(`SELECT tbl_name FROM sqlite_master WHERE type = ?`, `table`)
+	rows, err := self.doQuery(sqlgen.RawQuery(`SELECT tbl_name FROM sqlite_master WHERE type = ?`, `table`))
 
 	if err != nil {
 		return nil, err
@@ -254,6 +523,10 @@ func (self *Source) Collection(name string) (db.Collection, error) {
 
 	table.source = self
 	table.DB = self
+	table.Source = self
+	table.ConvertFn = toInternal
+	// SQLite has a single writer.
+	table.ConsecutiveIDs = true
 
 	table.SetName = name
 
@@ -263,7 +536,7 @@ func (self *Source) Collection(name string) (db.Collection, error) {
 	}
 
 	// Fetching table datatypes and mapping to internal gotypes.
-	rows, err := table.source.session.Query(fmt.Sprintf(`PRAGMA TABLE_INFO('%s')`, table.Name()))
+	rows, err := table.source.doQuery(sqlgen.RawQuery(fmt.Sprintf(`PRAGMA TABLE_INFO('%s')`, table.Name())))
 
 	if err != nil {
 		return table, err
@@ -272,6 +545,7 @@ func (self *Source) Collection(name string) (db.Collection, error) {
 	columns := []struct {
 		Name string
 		Type string
+		Pk   int
 	}{}
 
 	err = table.FetchRows(&columns, rows)
@@ -318,6 +592,24 @@ func (self *Source) Collection(name string) (db.Collection, error) {
 		table.ColumnTypes[column.Name] = ctype
 	}
 
+	// Columns of the primary key have their 1-based position within the key
+	// in pk, other columns have zero.
+	keys := 0
+
+	for _, column := range columns {
+		if column.Pk > 0 {
+			keys++
+		}
+	}
+
+	table.PrimaryKeys = make([]string, keys)
+
+	for _, column := range columns {
+		if column.Pk > 0 && column.Pk <= keys {
+			table.PrimaryKeys[column.Pk-1] = column.Name
+		}
+	}
+
 	self.collections[name] = table
 
 	return table, nil
@@ -35,8 +35,8 @@ package sqlite
 
 import (
 	"database/sql"
+	"fmt"
 	"menteslibres.net/gosexy/to"
-	"os"
 	"reflect"
 	"strings"
 	"testing"
@@ -93,7 +93,7 @@ var testValues = testValuesStruct{
 // Enabling outputting some information to stdout (like the SQL query and its
 // arguments), useful for development.
 func TestEnableDebug(t *testing.T) {
-	os.Setenv(db.EnvEnableDebug, "TRUE")
+	db.SetLogger(db.StdLogger)
 }
 
 // Trying to open an empty datasource, it must fail.
@@ -105,6 +105,94 @@ func TestOpenFailed(t *testing.T) {
 	}
 }
 
+// Patterns of the REGEXP operator are compiled once.
+func TestRegexpMatch(t *testing.T) {
+	for _, s := range []string{`Hayao`, `Satoshi`} {
+		matched, err := regexpMatch(`^H.*o$`, s)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		if matched != (s == `Hayao`) {
+			t.Fatalf("Unexpected match %v for %s.", matched, s)
+		}
+	}
+
+	if regexps[`^H.*o$`] == nil {
+		t.Fatalf("Expecting the pattern to be cached.")
+	}
+
+	if _, err := regexpMatch(`(`, `Hayao`); err == nil {
+		t.Fatalf("Expecting an error.")
+	}
+
+	for _, v := range []interface{}{[]byte(`Hayao`), int64(1337)} {
+		if matched, _ := regexpMatch(`^(H|1)`, v); matched == false {
+			t.Fatalf("Expecting %v to match.", v)
+		}
+	}
+
+	// NULL columns don't match instead of failing the query.
+	sess, err := db.Open(wrapperName, settings)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer sess.Close()
+
+	artist, _ := sess.Collection("artist")
+	artist.Truncate()
+
+	if _, err = sess.Exec(`INSERT INTO artist (id, name) VALUES (1, NULL), (2, 'Hayao Miyazaki')`); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	tests := []struct {
+		cond  db.Cond
+		total uint64
+	}{
+		{db.Cond{"name REGEXP": "^H"}, 1},
+		{db.Cond{"id REGEXP": "^2$"}, 1},
+	}
+
+	for _, test := range tests {
+		total, err := artist.Find(test.cond).Count()
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		if total != test.total {
+			t.Fatalf("%v: Expecting %d items, got %d.", test.cond, test.total, total)
+		}
+	}
+}
+
+// Attempts to open a database with adapter options.
+func TestOpenOptions(t *testing.T) {
+	var err error
+	var sess db.Database
+
+	options := settings
+	options.Options = map[string]string{`busy_timeout`: `2000`, `journal_mode`: `delete`}
+
+	if sess, err = db.Open(wrapperName, options); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	if err = sess.Ping(); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	sess.Close()
+
+	options.Options = map[string]string{`journal_mode`: `foo`}
+
+	if _, err = db.Open(wrapperName, options); err == nil {
+		t.Fatalf("Expecting an error.")
+	}
+
+	if err.(*db.OptionError).Err != db.ErrInvalidOptionValue {
+		t.Fatalf("Expecting ErrInvalidOptionValue.")
+	}
+}
+
 // Truncates all collections.
 func TestTruncate(t *testing.T) {
 
@@ -539,7 +627,7 @@ func TestFunction(t *testing.T) {
 		t.Fatalf("One: %q", err)
 	}
 
-	res = artist.Find(db.Cond{"id": db.Func{"NOT IN", []int{0, -1}}})
+	res = artist.Find(db.Cond{"id": db.Func{Name: "NOT IN", Args: []int{0, -1}}})
 
 	if err = res.One(&row_s); err != nil {
 		t.Fatalf("One: %q", err)
@@ -631,9 +719,62 @@ func TestDataTypes(t *testing.T) {
 	}
 }
 
+// Appending more rows than a single statement can take.
+func TestAppendAll(t *testing.T) {
+	var err error
+	var sess db.Database
+
+	if sess, err = db.Open(wrapperName, settings); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	defer sess.Close()
+
+	artist, err := sess.Collection("artist")
+
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	if err = artist.Truncate(); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	items := make([]map[string]string, 1500)
+	for i := range items {
+		items[i] = map[string]string{"name": fmt.Sprintf("Artist %d", i)}
+	}
+
+	ids, err := artist.AppendAll(items)
+
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	if len(ids) != len(items) {
+		t.Fatalf("Expecting %d IDs, got %d.", len(items), len(ids))
+	}
+
+	for i := range ids {
+		var item struct {
+			Name string `db:"name"`
+		}
+		if err = artist.Find(db.Cond{"id": ids[i]}).One(&item); err != nil {
+			t.Fatalf(err.Error())
+		}
+		if item.Name != items[i]["name"] {
+			t.Fatalf("Expecting %q, got %q.", items[i]["name"], item.Name)
+		}
+	}
+
+	if _, err = artist.AppendAll("Hayao Miyazaki"); err != db.ErrExpectingSliceMapStruct {
+		t.Fatalf("Expecting db.ErrExpectingSliceMapStruct, got %v.", err)
+	}
+}
+
 // We are going to benchmark the engine, so this is no longed needed.
 func TestDisableDebug(t *testing.T) {
-	os.Setenv(db.EnvEnableDebug, "")
+	db.SetLogger(nil)
 }
 
 // Benchmarking raw database/sql.
@@ -741,3 +882,51 @@ func BenchmarkAppendStruct(b *testing.B) {
 		}
 	}
 }
+
+// Benchmarking AppendAll() with maps.
+func BenchmarkAppendAllDbItem(b *testing.B) {
+	sess, err := db.Open(wrapperName, settings)
+
+	if err != nil {
+		b.Fatalf(err.Error())
+	}
+
+	defer sess.Close()
+
+	artist, err := sess.Collection("artist")
+	artist.Truncate()
+
+	items := make([]map[string]string, b.N)
+	for i := range items {
+		items[i] = map[string]string{"name": "Leonardo DaVinci"}
+	}
+
+	b.ResetTimer()
+	if _, err = artist.AppendAll(items); err != nil {
+		b.Fatalf(err.Error())
+	}
+}
+
+// Benchmarking AppendAll() with structs.
+func BenchmarkAppendAllStruct(b *testing.B) {
+	sess, err := db.Open(wrapperName, settings)
+
+	if err != nil {
+		b.Fatalf(err.Error())
+	}
+
+	defer sess.Close()
+
+	artist, err := sess.Collection("artist")
+	artist.Truncate()
+
+	items := make([]struct{ Name string }, b.N)
+	for i := range items {
+		items[i].Name = "John Lennon"
+	}
+
+	b.ResetTimer()
+	if _, err = artist.AppendAll(items); err != nil {
+		b.Fatalf(err.Error())
+	}
+}
@@ -0,0 +1,140 @@
+/*
+  Copyright (c) 2012-2014 José Carlos Nieto, https://menteslibres.net/xiam
+
+  Permission is hereby granted, free of charge, to any person obtaining
+  a copy of this software and associated documentation files (the
+  "Software"), to deal in the Software without restriction, including
+  without limitation the rights to use, copy, modify, merge, publish,
+  distribute, sublicense, and/or sell copies of the Software, and to
+  permit persons to whom the Software is furnished to do so, subject to
+  the following conditions:
+
+  The above copyright notice and this permission notice shall be
+  included in all copies or substantial portions of the Software.
+
+  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+  EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+  MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+  NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+  LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+  OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+  WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+
+package sqlite
+
+import (
+	"strings"
+	"upper.io/db/util/sqlgen"
+)
+
+// SQLite syntax for sqlgen.
+type dialect struct{}
+
+// SQLite operators besides the standard ones.
+var operators = map[string]bool{
+	`==`:       true,
+	`GLOB`:     true,
+	`NOT GLOB`: true,
+}
+
+func (self dialect) QuoteIdentifier(name string) (string, bool) {
+	return `"` + strings.Replace(name, `"`, `""`, -1) + `"`, true
+}
+
+func (self dialect) Placeholder(n int) string {
+	return `?`
+}
+
+func (self dialect) Operator(op string) (string, bool) {
+	if operators[op] {
+		return op, true
+	}
+	return sqlgen.StandardOperator(op)
+}
+
+// SQLite's LIKE is case insensitive, so LIKE patterns are rewritten as GLOB
+// patterns, which are not. REGEXP uses the function registered by this
+// adapter.
+func (self dialect) Match(column string, op string, pattern string, bind func(interface{}) string) string {
+	switch op {
+	case `LIKE`:
+		return column + ` GLOB ` + bind(likeToGlob(pattern))
+	case `NOT LIKE`:
+		return column + ` NOT GLOB ` + bind(likeToGlob(pattern))
+	case `ILIKE`:
+		return column + ` LIKE ` + bind(pattern) + ` ESCAPE '\'`
+	case `NOT ILIKE`:
+		return column + ` NOT LIKE ` + bind(pattern) + ` ESCAPE '\'`
+	}
+	return column + ` ` + op + ` ` + bind(pattern)
+}
+
+// Converts a LIKE pattern into a GLOB pattern.
+func likeToGlob(pattern string) string {
+	glob := make([]rune, 0, len(pattern))
+	escaped := false
+
+	for _, r := range pattern {
+		switch {
+		case escaped == false && r == '\\':
+			escaped = true
+			continue
+		case escaped == false && r == '%':
+			glob = append(glob, '*')
+		case escaped == false && r == '_':
+			glob = append(glob, '?')
+		case r == '*' || r == '?' || r == '[':
+			glob = append(glob, '[', r, ']')
+		default:
+			glob = append(glob, r)
+		}
+		escaped = false
+	}
+
+	return string(glob)
+}
+
+// SQLite does not accept OFFSET without LIMIT.
+func (self dialect) LimitOffset(limit int, offset int) string {
+	if limit == 0 && offset > 0 {
+		return `LIMIT -1 ` + sqlgen.LimitOffset(0, offset)
+	}
+	return sqlgen.LimitOffset(limit, offset)
+}
+
+// SQLite has no TRUNCATE statement.
+func (self dialect) Truncate(table string) string {
+	return `DELETE FROM ` + table
+}
+
+func (self dialect) SupportsHaving() bool {
+	return true
+}
+
+func (self dialect) Join(kind string) (string, bool) {
+	return kind, true
+}
+
+func (self dialect) SupportsReturning() bool {
+	return false
+}
+
+// Default SQLITE_MAX_VARIABLE_NUMBER of SQLite versions before 3.32.0.
+func (self dialect) MaxArguments() int {
+	return 999
+}
+
+func (self dialect) OnConflict(conflict []string, update []string) (string, bool) {
+	return sqlgen.OnConflict(conflict, update, `excluded`), true
+}
+
+// Numbers are passed as they are, so they compare as numbers against
+// expressions without a column affinity, like aggregates.
+func (self dialect) Value(v interface{}) interface{} {
+	switch v.(type) {
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64:
+		return v
+	}
+	return toInternal(v)
+}
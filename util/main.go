@@ -24,9 +24,11 @@
 package util
 
 import (
+	"context"
 	"menteslibres.net/gosexy/to"
 	"reflect"
 	"regexp"
+	"sort"
 	"strings"
 	"time"
 	"upper.io/db"
@@ -102,6 +104,11 @@ func GetStructFieldIndex(t reflect.Type, columnName string) []int {
 			continue
 		}
 
+		// Relations are not columns.
+		if _, ok := relationOf(fieldOptions); ok == true {
+			continue
+		}
+
 		// Attempt to match field name.
 		if fieldName == columnName {
 			return []int{i}
@@ -115,6 +122,14 @@ func GetStructFieldIndex(t reflect.Type, columnName string) []int {
 
 		// Inline option.
 		if fieldOptions["inline"] == true {
+			// Named inline fields take the columns prefixed by their name, as
+			// in "c.name", which is how the columns of joined tables are named.
+			if fieldName != "" && strings.HasPrefix(columnName, fieldName+".") {
+				index := GetStructFieldIndex(field.Type, columnName[len(fieldName)+1:])
+				if index != nil {
+					return append([]int{i}, index...)
+				}
+			}
 			index := GetStructFieldIndex(field.Type, columnName)
 			if index != nil {
 				res := append([]int{i}, index...)
@@ -201,3 +216,331 @@ func StringToKind(src string, dstk reflect.Kind) (reflect.Value, error) {
 
 	return srcv, nil
 }
+
+/*
+	Replaces errors caused by the cancellation or expiration of the given context
+	with db.ErrQueryCanceled or db.ErrQueryTimeout.
+*/
+func ContextError(ctx context.Context, err error) error {
+	if err == nil || err == db.ErrNoMoreRows {
+		return err
+	}
+
+	if ctx != nil && ctx.Err() != nil {
+		err = ctx.Err()
+	}
+
+	switch err {
+	case context.Canceled:
+		return db.ErrQueryCanceled
+	case context.DeadlineExceeded:
+		return db.ErrQueryTimeout
+	}
+
+	return err
+}
+
+/*
+	Returns a *db.OptionError for the first option (in alphabetical order) whose
+	key is not within the given list of known keys.
+*/
+func CheckOptions(options map[string]string, known ...string) error {
+	keys := make([]string, 0, len(options))
+
+	for key := range options {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		found := false
+		for _, k := range known {
+			if k == key {
+				found = true
+				break
+			}
+		}
+		if found == false {
+			return &db.OptionError{Key: key, Value: options[key], Err: db.ErrUnknownOption}
+		}
+	}
+
+	return nil
+}
+
+/*
+	Converts a LIKE pattern into an anchored regular expression, for databases
+	that match strings with regular expressions only. "%" matches any sequence
+	of characters, "_" matches a single character and "\" escapes the next
+	character.
+*/
+func LikeToRegexp(pattern string) string {
+	expr := []string{`(?s)^`}
+	escaped := false
+
+	for _, r := range pattern {
+		switch {
+		case escaped == false && r == '\\':
+			escaped = true
+			continue
+		case escaped == false && r == '%':
+			expr = append(expr, `.*`)
+		case escaped == false && r == '_':
+			expr = append(expr, `.`)
+		default:
+			expr = append(expr, regexp.QuoteMeta(string(r)))
+		}
+		escaped = false
+	}
+
+	return strings.Join(append(expr, `$`), ``)
+}
+
+/*
+	Converts the fields given to Select() or Sort() into names, for adapters
+	that don't support db.Raw expressions.
+*/
+func FieldNames(fields []interface{}) ([]string, error) {
+	names := make([]string, len(fields))
+
+	for i := range fields {
+		name, ok := fields[i].(string)
+		if ok == false {
+			return nil, db.ErrFeatureNotSupported
+		}
+		names[i] = name
+	}
+
+	return names, nil
+}
+
+// Context key for the struct types whose relations are being fetched.
+type relationChainKey struct{}
+
+/*
+	A struct field filled with the items of another collection. Relations are
+	declared with a tag like db:"author,{authors.id = author_id}", meaning the
+	field takes the items of the "authors" collection whose "id" equals the
+	"author_id" column of the item. Struct and pointer fields take the first
+	match, slice fields take all of them.
+*/
+type Relation struct {
+	// Related collection.
+	Collection string
+
+	// Column of the related collection.
+	Column string
+
+	// Column of the item the related column is compared to.
+	Key string
+}
+
+// Returns the relation declared within the given tag options, if any.
+func relationOf(options tagOptions) (string, bool) {
+	for option := range options {
+		if extRelationPattern.MatchString(option) {
+			return option, true
+		}
+	}
+	return "", false
+}
+
+/*
+	Returns the relation declared by the tag of the given struct field, false if
+	the field doesn't declare one and db.ErrInvalidRelation if it can't be
+	parsed.
+*/
+func ParseRelation(field reflect.StructField) (*Relation, bool, error) {
+	_, options := ParseTag(field.Tag.Get("db"))
+
+	option, ok := relationOf(options)
+	if ok == false {
+		return nil, false, nil
+	}
+
+	sides := strings.Split(extRelationPattern.FindStringSubmatch(option)[1], "=")
+	if len(sides) != 2 {
+		return nil, true, db.ErrInvalidRelation
+	}
+
+	related, key := strings.TrimSpace(sides[0]), strings.TrimSpace(sides[1])
+
+	// The related column is the one qualified by its collection name.
+	if strings.Contains(related, ".") == false {
+		related, key = key, related
+	}
+
+	chunks := strings.SplitN(related, ".", 2)
+	if len(chunks) != 2 || chunks[0] == "" || chunks[1] == "" || key == "" {
+		return nil, true, db.ErrInvalidRelation
+	}
+
+	return &Relation{Collection: chunks[0], Column: chunks[1], Key: key}, true, nil
+}
+
+/*
+	Fills the relations of the items dst points to, which is either a struct or
+	a slice of structs, with one IN query per relation. Relations are fetched
+	with the given context, and so are the relations of the related items,
+	except those pointing back to a type that is already being fetched, as that
+	would never end.
+*/
+func FetchRelations(ctx context.Context, sess db.Database, dst interface{}) error {
+	dstv := reflect.ValueOf(dst)
+
+	if dstv.Kind() != reflect.Ptr || dstv.IsNil() {
+		return nil
+	}
+
+	dstv = dstv.Elem()
+
+	itemt := dstv.Type()
+	if itemt.Kind() == reflect.Slice {
+		itemt = itemt.Elem()
+	}
+	if itemt.Kind() == reflect.Ptr {
+		itemt = itemt.Elem()
+	}
+
+	if itemt.Kind() != reflect.Struct {
+		return nil
+	}
+
+	var items []reflect.Value
+
+	if dstv.Kind() == reflect.Slice {
+		items = make([]reflect.Value, 0, dstv.Len())
+		for i := 0; i < dstv.Len(); i++ {
+			item := dstv.Index(i)
+			if item.Kind() == reflect.Ptr {
+				if item.IsNil() {
+					continue
+				}
+				item = item.Elem()
+			}
+			items = append(items, item)
+		}
+	} else {
+		items = []reflect.Value{dstv}
+	}
+
+	if len(items) == 0 {
+		return nil
+	}
+
+	chain, _ := ctx.Value(relationChainKey{}).([]reflect.Type)
+	chain = append(chain[:len(chain):len(chain)], itemt)
+
+	for i := 0; i < itemt.NumField(); i++ {
+		field := itemt.Field(i)
+
+		if field.PkgPath != "" {
+			// Field is unexported.
+			continue
+		}
+
+		relation, ok, err := ParseRelation(field)
+		if err != nil {
+			return err
+		}
+
+		if ok == false {
+			continue
+		}
+
+		if err = fetchRelation(ctx, sess, chain, items, i, relation); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Fills the field with the given index of all items with a single query.
+func fetchRelation(ctx context.Context, sess db.Database, chain []reflect.Type, items []reflect.Value, index int, relation *Relation) error {
+	fieldt := items[0].Type().Field(index).Type
+
+	relatedt := fieldt
+	many := relatedt.Kind() == reflect.Slice
+	if many {
+		relatedt = relatedt.Elem()
+	}
+	ptr := relatedt.Kind() == reflect.Ptr
+	if ptr {
+		relatedt = relatedt.Elem()
+	}
+
+	if relatedt.Kind() != reflect.Struct {
+		return db.ErrUnsupportedDestination
+	}
+
+	for _, t := range chain {
+		if t == relatedt {
+			return nil
+		}
+	}
+
+	keyIndex := GetStructFieldIndex(items[0].Type(), relation.Key)
+	columnIndex := GetStructFieldIndex(relatedt, relation.Column)
+
+	if keyIndex == nil || columnIndex == nil {
+		return db.ErrInvalidRelation
+	}
+
+	// Distinct values of the key.
+	keys := make([]interface{}, 0, len(items))
+	seen := make(map[string]bool)
+
+	for _, item := range items {
+		key := item.FieldByIndex(keyIndex).Interface()
+		if seen[to.String(key)] == false {
+			seen[to.String(key)] = true
+			keys = append(keys, key)
+		}
+	}
+
+	col, err := sess.Collection(relation.Collection)
+	if err != nil {
+		return err
+	}
+
+	relatedv := reflect.New(reflect.SliceOf(relatedt))
+
+	res := col.Find(db.Cond{relation.Column + " IN": keys})
+	res = res.WithContext(context.WithValue(ctx, relationChainKey{}, chain))
+
+	if err = res.All(relatedv.Interface()); err != nil {
+		return err
+	}
+
+	// Related items by the value of their column.
+	matches := make(map[string][]reflect.Value)
+
+	for i := 0; i < relatedv.Elem().Len(); i++ {
+		related := relatedv.Elem().Index(i)
+		key := to.String(related.FieldByIndex(columnIndex).Interface())
+		if ptr {
+			related = related.Addr()
+		}
+		matches[key] = append(matches[key], related)
+	}
+
+	for _, item := range items {
+		found := matches[to.String(item.FieldByIndex(keyIndex).Interface())]
+		fieldv := item.Field(index)
+
+		switch {
+		case many:
+			slicev := reflect.MakeSlice(fieldt, 0, len(found))
+			slicev = reflect.Append(slicev, found...)
+			fieldv.Set(slicev)
+		case len(found) == 0:
+			fieldv.Set(reflect.Zero(fieldt))
+		default:
+			fieldv.Set(found[0])
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,733 @@
+/*
+  Copyright (c) 2012-2014 José Carlos Nieto, https://menteslibres.net/xiam
+
+  Permission is hereby granted, free of charge, to any person obtaining
+  a copy of this software and associated documentation files (the
+  "Software"), to deal in the Software without restriction, including
+  without limitation the rights to use, copy, modify, merge, publish,
+  distribute, sublicense, and/or sell copies of the Software, and to
+  permit persons to whom the Software is furnished to do so, subject to
+  the following conditions:
+
+  The above copyright notice and this permission notice shall be
+  included in all copies or substantial portions of the Software.
+
+  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+  EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+  MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+  NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+  LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+  OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+  WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+
+// Package sqlgen builds SQL statements for the SQL adapters. Statements are
+// described by a Statement value and compiled into SQL by a Dialect, so the
+// adapters only need to define the syntax that sets them apart.
+package sqlgen
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"upper.io/db"
+)
+
+var (
+	errMissingTable   = errors.New(`Missing table name.`)
+	errMissingColumns = errors.New(`Columns and values don't match.`)
+)
+
+// Describes the syntax of a SQL database.
+type Dialect interface {
+	// Quotes a table or column name, returns false if the name can't be used
+	// as an identifier.
+	QuoteIdentifier(name string) (string, bool)
+
+	// Returns the placeholder of the nth argument of a statement, n starts at 1.
+	Placeholder(n int) string
+
+	// Translates a comparison or logical operator (=, <, AND, OR...) into the
+	// dialect's operator, returns false if the dialect doesn't support it.
+	// Operators are given in upper case with single spaces between words.
+	Operator(op string) (string, bool)
+
+	// Compiles a condition that matches a quoted column against a pattern, op
+	// is one of LIKE, ILIKE, REGEXP, NOT LIKE, NOT ILIKE and NOT REGEXP. The
+	// bind function adds the (maybe rewritten) pattern as an argument and
+	// returns its placeholder.
+	Match(column string, op string, pattern string, bind func(interface{}) string) string
+
+	// Returns the clause that limits the number of returned rows, a zero limit
+	// or offset means the clause should not constrain it.
+	LimitOffset(limit int, offset int) string
+
+	// Returns a statement that deletes all the rows of the given (quoted)
+	// table.
+	Truncate(table string) string
+
+	// Returns true if INSERT statements can return columns of the new row.
+	SupportsReturning() bool
+
+	// Returns true if SELECT statements can filter groups with HAVING.
+	SupportsHaving() bool
+
+	// Returns the keyword of the given kind of join, InnerJoin or LeftJoin.
+	// Returns false if the dialect can't join tables that way.
+	Join(kind string) (string, bool)
+
+	// Returns the maximum number of arguments a statement can have, zero means
+	// there's no limit.
+	MaxArguments() int
+
+	// Returns the clause that makes an INSERT statement update the row that
+	// conflicts with the new one on the given (quoted) columns, setting the
+	// update columns to their new values. Returns false if the dialect has no
+	// such clause.
+	OnConflict(conflict []string, update []string) (string, bool)
+
+	// Converts a Go value used in a condition into the representation the
+	// driver expects.
+	Value(interface{}) interface{}
+}
+
+// A SELECT statement that can be the value of a condition, like the db.Result
+// of a SQL adapter.
+type Subquery interface {
+	// Returns the statement and the dialect it's written in.
+	Subquery() (*Statement, Dialect)
+}
+
+// Numbers the placeholders of a subquery after the arguments that come before
+// it.
+type offsetDialect struct {
+	Dialect
+	offset int
+}
+
+func (self offsetDialect) Placeholder(n int) string {
+	return self.Dialect.Placeholder(self.offset + n)
+}
+
+// Returns the dialect the given one wraps, if it does.
+func baseDialect(d Dialect) Dialect {
+	if o, ok := d.(offsetDialect); ok {
+		return baseDialect(o.Dialect)
+	}
+	return d
+}
+
+// Kinds of joins.
+const (
+	InnerJoin = `JOIN`
+	LeftJoin  = `LEFT JOIN`
+)
+
+// A table joined to the table of a SELECT statement.
+type Join struct {
+	// InnerJoin or LeftJoin.
+	Kind string
+
+	// Table name, may be followed by an alias ("customers c").
+	Table string
+
+	// Conditions rows are joined on, like Where. Strings are written as is.
+	On []interface{}
+}
+
+// Type of a statement.
+type Type uint8
+
+const (
+	// SQL given as is, with ? placeholders.
+	Raw Type = iota
+	Select
+	Count
+	Insert
+	Update
+	Delete
+	Truncate
+)
+
+// Statement is the AST of a SQL statement.
+type Statement struct {
+	Type Type
+
+	// Table name, quoted by the dialect.
+	Table string
+
+	// Tables joined to Table in SELECT and count statements.
+	Joins []Join
+
+	// Fields of a SELECT statement, either strings, db.Raw or db.Aggregate
+	// expressions. Field names may be qualified by a table name (table.field)
+	// and have an alias (field AS alias).
+	Fields []interface{}
+
+	// Makes a SELECT statement return distinct rows only, and a count
+	// statement count them.
+	Distinct bool
+
+	// Columns of an INSERT or UPDATE statement.
+	Columns []string
+
+	// Values of an INSERT or UPDATE statement, in the same order as Columns.
+	// Values are not converted by the dialect, db.Raw values are written as
+	// is.
+	Values []interface{}
+
+	// Rows of a multi-row INSERT statement, each one like Values. Values is
+	// ignored if there are any rows.
+	Rows [][]interface{}
+
+	// Conditions of SELECT, UPDATE and DELETE statements: db.Cond, db.And,
+	// db.Or, db.Not, db.Raw or slices of them, which are joined by AND.
+	Where []interface{}
+
+	// Primary key columns of the table, db.Key conditions are compiled as
+	// equalities on them.
+	PrimaryKey []string
+
+	// Fields a SELECT statement groups rows by, either strings or db.Raw
+	// expressions.
+	GroupBy []interface{}
+
+	// Conditions on the groups of a SELECT statement, like Where. Columns
+	// named after a db.Aggregate of Fields refer to the aggregate.
+	Having []interface{}
+
+	// Sort order of a SELECT statement, a field name prefixed by a minus
+	// sign means descending order. db.Raw expressions are written as is.
+	OrderBy []interface{}
+
+	// Maximum number of rows and number of skipped rows of a SELECT statement,
+	// zero means no limit.
+	Limit  int
+	Offset int
+
+	// Columns an INSERT statement returns, * returns all of them.
+	Returning []string
+
+	// Columns that identify the row of an INSERT statement, if set, a row that
+	// already has the same values in them is updated instead.
+	OnConflict []string
+
+	// SQL and arguments of a Raw statement.
+	SQL  string
+	Args []interface{}
+}
+
+// Returns a Raw statement, placeholders are written as ? regardless of the
+// dialect.
+func RawQuery(sql string, args ...interface{}) *Statement {
+	return &Statement{Type: Raw, SQL: sql, Args: args}
+}
+
+// Comparison and logical operators every SQL dialect understands.
+var standardOperators = map[string]bool{
+	`=`:      true,
+	`!=`:     true,
+	`<>`:     true,
+	`<`:      true,
+	`<=`:     true,
+	`>`:      true,
+	`>=`:     true,
+	`IS`:     true,
+	`IS NOT`: true,
+	`AND`:    true,
+	`OR`:     true,
+	`NOT`:    true,
+}
+
+// Returns the given operator if it's a standard SQL operator, dialects may
+// use it after checking their own operators.
+func StandardOperator(op string) (string, bool) {
+	if standardOperators[op] {
+		return op, true
+	}
+	return "", false
+}
+
+// Holds the arguments of the statement being compiled.
+type compiler struct {
+	dialect    Dialect
+	args       []interface{}
+	primaryKey []string
+	// Aggregates that columns of conditions refer to, by name.
+	aggregates map[string]string
+	// First error found while compiling.
+	err error
+}
+
+// Records an error, only the first one is returned by Compile.
+func (self *compiler) fail(err error) {
+	if self.err == nil {
+		self.err = err
+	}
+}
+
+// Quotes a table or column name.
+func (self *compiler) quote(name string) string {
+	quoted, ok := self.dialect.QuoteIdentifier(name)
+	if ok == false || name == "" {
+		self.fail(&db.QueryError{Value: name, Err: db.ErrInvalidIdentifier})
+	}
+	return quoted
+}
+
+// Quotes a field name, which may be qualified by a table name, be a * or have
+// an alias.
+func (self *compiler) identifier(name string) string {
+	name = strings.TrimSpace(name)
+
+	if i := strings.Index(strings.ToUpper(name), ` AS `); i > 0 {
+		return self.identifier(name[:i]) + ` AS ` + self.quote(strings.TrimSpace(name[i+4:]))
+	}
+
+	chunks := strings.Split(name, `.`)
+
+	for i := range chunks {
+		if chunks[i] != `*` {
+			chunks[i] = self.quote(chunks[i])
+		}
+	}
+
+	return strings.Join(chunks, `.`)
+}
+
+// Returns the operator in upper case with single spaces between words, so
+// "not in" and "NOT  IN" are the same.
+func normalize(op string) string {
+	return strings.Join(strings.Fields(strings.ToUpper(op)), ` `)
+}
+
+// Adds an argument and returns its placeholder, db.Raw values are written as
+// is.
+func (self *compiler) value(arg interface{}) string {
+	if raw, ok := arg.(db.Raw); ok {
+		return self.raw(raw)
+	}
+	return self.bind(arg)
+}
+
+// Writes a raw expression, binding its arguments.
+func (self *compiler) raw(raw db.Raw) string {
+	return self.rebind(raw.Value, raw.Args)
+}
+
+// Compiles a subquery within parentheses, its arguments are added after the
+// current ones. key is the db.Cond key the subquery is the value of.
+func (self *compiler) subquery(key string, sub Subquery) string {
+	stmt, d := sub.Subquery()
+
+	if stmt == nil || stmt.Type != Select || d != baseDialect(self.dialect) {
+		self.fail(&db.QueryError{Value: key, Err: db.ErrInvalidConditionValue})
+		return ""
+	}
+
+	return self.nested(stmt)
+}
+
+// Compiles a statement within parentheses, its arguments are added after the
+// current ones.
+func (self *compiler) nested(stmt *Statement) string {
+	sql, args, err := stmt.Compile(offsetDialect{self.dialect, len(self.args)})
+	if err != nil {
+		self.fail(err)
+		return ""
+	}
+
+	self.args = append(self.args, args...)
+
+	return `(` + sql + `)`
+}
+
+// Compiles a field of a SELECT statement.
+func (self *compiler) field(field interface{}) string {
+	switch f := field.(type) {
+	case string:
+		return self.identifier(f)
+	case db.Raw:
+		return self.raw(f)
+	case db.Aggregate:
+		return self.aggregate(f) + ` AS ` + self.quote(f.Alias())
+	}
+	self.fail(&db.QueryError{Value: fmt.Sprintf(`%v`, field), Err: db.ErrInvalidIdentifier})
+	return ""
+}
+
+// Compiles a field of a GROUP BY clause.
+func (self *compiler) group(field interface{}) string {
+	switch f := field.(type) {
+	case string:
+		return self.identifier(f)
+	case db.Raw:
+		return self.raw(f)
+	}
+	self.fail(&db.QueryError{Value: fmt.Sprintf(`%v`, field), Err: db.ErrInvalidIdentifier})
+	return ""
+}
+
+// Aggregate functions, written in lower case since some dialects don't
+// accept them otherwise.
+var aggregates = map[string]string{
+	`COUNT`: `count`,
+	`SUM`:   `sum`,
+	`AVG`:   `avg`,
+	`MIN`:   `min`,
+	`MAX`:   `max`,
+}
+
+// Compiles an aggregate function, without its name.
+func (self *compiler) aggregate(a db.Aggregate) string {
+	fn, ok := aggregates[strings.ToUpper(a.Func)]
+	if ok == false {
+		self.fail(&db.QueryError{Value: a.Func, Err: db.ErrUnknownAggregate})
+		return ""
+	}
+	if a.Field == `*` {
+		return fn + `(*)`
+	}
+	return fn + `(` + self.identifier(a.Field) + `)`
+}
+
+// Translates an operator into the dialect's operator.
+func (self *compiler) operator(op string) string {
+	op = normalize(op)
+	translated, ok := self.dialect.Operator(op)
+	if ok == false {
+		self.fail(&db.QueryError{Value: op, Err: db.ErrUnknownOperator})
+	}
+	return translated
+}
+
+// Adds an argument and returns its placeholder.
+func (self *compiler) bind(arg interface{}) string {
+	self.args = append(self.args, arg)
+	return self.dialect.Placeholder(len(self.args))
+}
+
+// Compiles the statement into SQL and arguments for the given dialect.
+func (self *Statement) Compile(d Dialect) (string, []interface{}, error) {
+	c := &compiler{dialect: d, args: []interface{}{}, primaryKey: self.PrimaryKey}
+
+	if self.Type == Raw {
+		return c.rebind(self.SQL, self.Args), c.args, nil
+	}
+
+	if self.Table == "" {
+		return "", nil, errMissingTable
+	}
+
+	table := c.quote(self.Table)
+
+	var sql []string
+	var err error
+
+	switch self.Type {
+	case Select:
+		fields := `*`
+		if len(self.Fields) > 0 {
+			columns := make([]string, len(self.Fields))
+			for i := range self.Fields {
+				columns[i] = c.field(self.Fields[i])
+			}
+			fields = strings.Join(columns, `, `)
+		}
+		sql = []string{`SELECT`, fields, `FROM`, table}
+		if self.Distinct {
+			sql = []string{`SELECT DISTINCT`, fields, `FROM`, table}
+		}
+		if sql, err = c.joins(sql, self.Joins); err != nil {
+			return "", nil, err
+		}
+		sql = c.where(sql, self.Where)
+		if len(self.GroupBy) > 0 {
+			columns := make([]string, len(self.GroupBy))
+			for i := range self.GroupBy {
+				columns[i] = c.group(self.GroupBy[i])
+			}
+			sql = append(sql, `GROUP BY`, strings.Join(columns, `, `))
+		}
+		if len(self.Having) > 0 {
+			if d.SupportsHaving() == false {
+				return "", nil, db.ErrFeatureNotSupported
+			}
+			c.aggregates = map[string]string{}
+			for i := range self.Fields {
+				if a, ok := self.Fields[i].(db.Aggregate); ok {
+					c.aggregates[a.Alias()] = c.aggregate(a)
+				}
+			}
+			if having := c.conditions(self.Having); having != "" {
+				sql = append(sql, `HAVING`, having)
+			}
+			c.aggregates = nil
+		}
+		if len(self.OrderBy) > 0 {
+			sql = append(sql, `ORDER BY`, c.orderBy(self.OrderBy))
+		}
+		if limit := d.LimitOffset(self.Limit, self.Offset); limit != "" {
+			sql = append(sql, limit)
+		}
+	case Count:
+		if self.Distinct || len(self.GroupBy) > 0 || len(self.Having) > 0 {
+			// Distinct and grouped rows are counted from a subquery.
+			sub := *self
+			sub.Type = Select
+			alias := `grouped_rows`
+			if self.Distinct {
+				alias = `distinct_rows`
+			}
+			sql = []string{`SELECT count(1) AS total FROM`, c.nested(&sub), `AS`, c.quote(alias)}
+			break
+		}
+		sql = []string{`SELECT count(1) AS total FROM`, table}
+		if sql, err = c.joins(sql, self.Joins); err != nil {
+			return "", nil, err
+		}
+		sql = c.where(sql, self.Where)
+	case Insert:
+		rows := self.Rows
+		if len(rows) == 0 {
+			rows = [][]interface{}{self.Values}
+		}
+		columns := make([]string, len(self.Columns))
+		for i := range self.Columns {
+			columns[i] = c.quote(self.Columns[i])
+		}
+		values := make([]string, len(rows))
+		for i := range rows {
+			if len(rows[i]) != len(self.Columns) {
+				return "", nil, errMissingColumns
+			}
+			row := make([]string, len(rows[i]))
+			for j := range rows[i] {
+				row[j] = c.value(rows[i][j])
+			}
+			values[i] = `(` + strings.Join(row, `, `) + `)`
+		}
+		sql = []string{
+			`INSERT INTO`, table,
+			`(` + strings.Join(columns, `, `) + `)`,
+			`VALUES`,
+			strings.Join(values, `, `),
+		}
+		if len(self.OnConflict) > 0 {
+			clause, ok := d.OnConflict(c.onConflict(self.OnConflict, self.Columns))
+			if ok == false {
+				return "", nil, db.ErrFeatureNotSupported
+			}
+			sql = append(sql, clause)
+		}
+		if len(self.Returning) > 0 {
+			if d.SupportsReturning() == false {
+				return "", nil, db.ErrFeatureNotSupported
+			}
+			returning := make([]string, len(self.Returning))
+			for i := range self.Returning {
+				returning[i] = c.identifier(self.Returning[i])
+			}
+			sql = append(sql, `RETURNING`, strings.Join(returning, `, `))
+		}
+	case Update:
+		if len(self.Columns) != len(self.Values) || len(self.Columns) == 0 {
+			return "", nil, errMissingColumns
+		}
+		set := make([]string, len(self.Columns))
+		for i := range self.Columns {
+			set[i] = c.quote(self.Columns[i]) + ` = ` + c.value(self.Values[i])
+		}
+		sql = []string{`UPDATE`, table, `SET`, strings.Join(set, `, `)}
+		sql = c.where(sql, self.Where)
+	case Delete:
+		sql = []string{`DELETE FROM`, table}
+		sql = c.where(sql, self.Where)
+	case Truncate:
+		sql = []string{d.Truncate(table)}
+	default:
+		return "", nil, db.ErrFeatureNotSupported
+	}
+
+	if c.err != nil {
+		return "", nil, c.err
+	}
+
+	return strings.Join(sql, ` `), c.args, nil
+}
+
+// Splits a multi-row INSERT statement into statements that stay within the
+// maximum number of arguments of the dialect. Other statements are returned as
+// they are.
+func (self *Statement) Split(d Dialect) []*Statement {
+	max := d.MaxArguments()
+
+	if self.Type != Insert || len(self.Rows) == 0 || max == 0 || len(self.Columns) == 0 {
+		return []*Statement{self}
+	}
+
+	size := max / len(self.Columns)
+	if size < 1 {
+		size = 1
+	}
+
+	stmts := make([]*Statement, 0, len(self.Rows)/size+1)
+
+	for i := 0; i < len(self.Rows); i += size {
+		end := i + size
+		if end > len(self.Rows) {
+			end = len(self.Rows)
+		}
+		stmt := *self
+		stmt.Rows = self.Rows[i:end]
+		stmts = append(stmts, &stmt)
+	}
+
+	return stmts
+}
+
+// Appends the joins of a SELECT statement.
+func (self *compiler) joins(sql []string, joins []Join) ([]string, error) {
+	for _, join := range joins {
+		keyword, ok := self.dialect.Join(join.Kind)
+		if ok == false {
+			return nil, db.ErrFeatureNotSupported
+		}
+
+		// Strings are written as is.
+		on := make([]interface{}, len(join.On))
+		for i := range join.On {
+			if s, ok := join.On[i].(string); ok {
+				on[i] = db.Raw{Value: s}
+			} else {
+				on[i] = join.On[i]
+			}
+		}
+
+		name, alias := SplitAlias(join.Table)
+
+		table := self.quote(name)
+		if alias != "" {
+			table = table + ` AS ` + self.quote(alias)
+		}
+
+		sql = append(sql, keyword, table)
+
+		if where := self.conditions(on); where != "" {
+			sql = append(sql, `ON`, where)
+		}
+	}
+	return sql, nil
+}
+
+// Splits a table name followed by an alias, as in "customers c" or "customers
+// AS c". The alias is empty if there's none.
+func SplitAlias(name string) (string, string) {
+	chunks := strings.Fields(name)
+	switch {
+	case len(chunks) == 2:
+		return chunks[0], chunks[1]
+	case len(chunks) == 3 && strings.ToUpper(chunks[1]) == `AS`:
+		return chunks[0], chunks[2]
+	}
+	return strings.TrimSpace(name), ""
+}
+
+// Appends the WHERE clause, if there are any conditions.
+func (self *compiler) where(sql []string, terms []interface{}) []string {
+	if where := self.conditions(terms); where != "" {
+		sql = append(sql, `WHERE`, where)
+	}
+	return sql
+}
+
+// Replaces ? placeholders with the placeholders of the dialect.
+func (self *compiler) rebind(sql string, args []interface{}) string {
+	chunks := strings.Split(sql, `?`)
+
+	for i := 0; i+1 < len(chunks); i++ {
+		if i < len(args) {
+			chunks[i] = chunks[i] + self.bind(args[i])
+		} else {
+			chunks[i] = chunks[i] + `?`
+		}
+	}
+
+	// Extra arguments are left to the driver to complain about.
+	for i := len(chunks) - 1; i < len(args); i++ {
+		self.args = append(self.args, args[i])
+	}
+
+	return strings.Join(chunks, ``)
+}
+
+// Returns the quoted conflict columns of an upsert and the quoted columns that
+// are updated on conflict.
+func (self *compiler) onConflict(conflict []string, columns []string) ([]string, []string) {
+	keys := make([]string, len(conflict))
+	isKey := map[string]bool{}
+
+	for i := range conflict {
+		keys[i] = self.quote(conflict[i])
+		isKey[conflict[i]] = true
+	}
+
+	update := []string{}
+
+	for i := range columns {
+		if isKey[columns[i]] == false {
+			update = append(update, self.quote(columns[i]))
+		}
+	}
+
+	return keys, update
+}
+
+// Compiles sort fields into the body of an ORDER BY clause.
+func (self *compiler) orderBy(fields []interface{}) string {
+	sort := make([]string, len(fields))
+
+	for i := range fields {
+		field, ok := fields[i].(string)
+		switch {
+		case ok == false:
+			sort[i] = self.field(fields[i])
+		case strings.HasPrefix(field, `-`) == true:
+			sort[i] = self.identifier(field[1:]) + ` DESC`
+		default:
+			sort[i] = self.identifier(field) + ` ASC`
+		}
+	}
+
+	return strings.Join(sort, `, `)
+}
+
+// Returns the standard ON CONFLICT clause of an upsert, excluded is the name
+// of the row that could not be inserted.
+func OnConflict(conflict []string, update []string, excluded string) string {
+	clause := `ON CONFLICT (` + strings.Join(conflict, `, `) + `) DO `
+
+	if len(update) == 0 {
+		return clause + `NOTHING`
+	}
+
+	set := make([]string, len(update))
+	for i := range update {
+		set[i] = update[i] + ` = ` + excluded + `.` + update[i]
+	}
+
+	return clause + `UPDATE SET ` + strings.Join(set, `, `)
+}
+
+// Returns the standard LIMIT and OFFSET clauses.
+func LimitOffset(limit int, offset int) string {
+	clauses := []string{}
+	if limit > 0 {
+		clauses = append(clauses, `LIMIT `+strconv.Itoa(limit))
+	}
+	if offset > 0 {
+		clauses = append(clauses, `OFFSET `+strconv.Itoa(offset))
+	}
+	return strings.Join(clauses, ` `)
+}
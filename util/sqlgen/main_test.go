@@ -0,0 +1,453 @@
+package sqlgen
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"upper.io/db"
+)
+
+// PostgreSQL-like dialect.
+type testDialect struct{}
+
+func (self testDialect) QuoteIdentifier(name string) (string, bool) {
+	return `"` + strings.Replace(name, `"`, `""`, -1) + `"`, true
+}
+
+func (self testDialect) Placeholder(n int) string {
+	return `$` + strconv.Itoa(n)
+}
+
+func (self testDialect) Operator(op string) (string, bool) {
+	return StandardOperator(op)
+}
+
+func (self testDialect) Match(column string, op string, pattern string, bind func(interface{}) string) string {
+	return column + ` ` + op + ` ` + bind(pattern)
+}
+
+func (self testDialect) LimitOffset(limit int, offset int) string {
+	return LimitOffset(limit, offset)
+}
+
+func (self testDialect) Truncate(table string) string {
+	return `TRUNCATE TABLE ` + table
+}
+
+func (self testDialect) Join(kind string) (string, bool) {
+	return kind, true
+}
+
+func (self testDialect) SupportsHaving() bool {
+	return true
+}
+
+func (self testDialect) SupportsReturning() bool {
+	return true
+}
+
+func (self testDialect) MaxArguments() int {
+	return 5
+}
+
+func (self testDialect) OnConflict(conflict []string, update []string) (string, bool) {
+	return OnConflict(conflict, update, `EXCLUDED`), true
+}
+
+func (self testDialect) Value(v interface{}) interface{} {
+	return v
+}
+
+// A subquery written in the given dialect.
+type testSubquery struct {
+	stmt    Statement
+	dialect Dialect
+}
+
+func (self testSubquery) Subquery() (*Statement, Dialect) {
+	return &self.stmt, self.dialect
+}
+
+// Some other dialect.
+type otherDialect struct {
+	testDialect
+}
+
+func TestCompile(t *testing.T) {
+	customers := testSubquery{
+		Statement{
+			Type:   Select,
+			Table:  `customer`,
+			Fields: []interface{}{`id`},
+			Where:  []interface{}{db.Cond{`region`: `north`}},
+		},
+		testDialect{},
+	}
+
+	tests := []struct {
+		stmt Statement
+		sql  string
+		args []interface{}
+	}{
+		{
+			Statement{Type: Select, Table: `artist`},
+			`SELECT * FROM "artist"`,
+			[]interface{}{},
+		},
+		{
+			Statement{
+				Type:    Select,
+				Table:   `artist`,
+				Fields:  []interface{}{`id`, `name`},
+				Where:   []interface{}{db.Cond{`name`: `Miyazaki`, `id >`: 5}},
+				OrderBy: []interface{}{`-id`, `name`},
+				Limit:   10,
+				Offset:  20,
+			},
+			`SELECT "id", "name" FROM "artist" WHERE (("id" > $1 AND "name" = $2)) ORDER BY "id" DESC, "name" ASC LIMIT 10 OFFSET 20`,
+			[]interface{}{5, `Miyazaki`},
+		},
+		{
+			Statement{
+				Type:  Count,
+				Table: `artist`,
+				Where: []interface{}{
+					db.Or{db.Cond{`id`: []int{1, 2}}, db.Cond{`name`: db.Func{Name: `LIKE`, Args: `M%`}}},
+					db.Cond{`id !=`: 3},
+				},
+			},
+			`SELECT count(1) AS total FROM "artist" WHERE (("id" IN ($1, $2) OR "name" LIKE ($3)) AND "id" != $4)`,
+			[]interface{}{1, 2, `M%`, 3},
+		},
+		{
+			Statement{
+				Type:      Insert,
+				Table:     `artist`,
+				Columns:   []string{`name`, `born`},
+				Values:    []interface{}{`Kon`, 1963},
+				Returning: []string{`id`},
+			},
+			`INSERT INTO "artist" ("name", "born") VALUES ($1, $2) RETURNING "id"`,
+			[]interface{}{`Kon`, 1963},
+		},
+		{
+			Statement{
+				Type:       Insert,
+				Table:      `artist`,
+				Columns:    []string{`id`, `name`, `born`},
+				Values:     []interface{}{1, `Kon`, 1963},
+				OnConflict: []string{`id`},
+			},
+			`INSERT INTO "artist" ("id", "name", "born") VALUES ($1, $2, $3) ON CONFLICT ("id") DO UPDATE SET "name" = EXCLUDED."name", "born" = EXCLUDED."born"`,
+			[]interface{}{1, `Kon`, 1963},
+		},
+		{
+			Statement{
+				Type:    Select,
+				Table:   `sale`,
+				Fields:  []interface{}{`region`, db.Sum(`total`), db.CountOf(`*`).As(`sales`)},
+				Where:   []interface{}{db.Cond{`year`: 2014}},
+				GroupBy: []interface{}{`region`},
+				Having:  []interface{}{db.Cond{`sum_total >`: 100, `region !=`: `north`}},
+				OrderBy: []interface{}{`-sales`},
+			},
+			`SELECT "region", sum("total") AS "sum_total", count(*) AS "sales" FROM "sale" WHERE ("year" = $1) GROUP BY "region" HAVING (("region" != $2 AND sum("total") > $3)) ORDER BY "sales" DESC`,
+			[]interface{}{2014, `north`, 100},
+		},
+		{
+			Statement{
+				Type:   Select,
+				Table:  `sale`,
+				Fields: []interface{}{`sale.total AS sale.total`, `c.name AS c.name`},
+				Joins: []Join{
+					{Kind: InnerJoin, Table: `customer c`, On: []interface{}{`sale.customer_id = c.id`}},
+					{Kind: LeftJoin, Table: `region AS r`, On: []interface{}{db.Cond{`r.id`: db.Raw{Value: `c.region_id`}}}},
+				},
+				Where: []interface{}{db.Cond{`sale.total >`: 10}},
+			},
+			`SELECT "sale"."total" AS "sale.total", "c"."name" AS "c.name" FROM "sale" JOIN "customer" AS "c" ON ((sale.customer_id = c.id)) LEFT JOIN "region" AS "r" ON ("r"."id" = c.region_id) WHERE ("sale"."total" > $1)`,
+			[]interface{}{10},
+		},
+		{
+			Statement{
+				Type:  Select,
+				Table: `sale`,
+				Where: []interface{}{
+					db.Cond{`amount >`: 10, `customer_id`: customers, `year`: 2014},
+					db.Cond{`seller_id !=`: customers},
+				},
+			},
+			`SELECT * FROM "sale" WHERE (("amount" > $1 AND "customer_id" IN (SELECT "id" FROM "customer" WHERE ("region" = $2)) AND "year" = $3) AND "seller_id" NOT IN (SELECT "id" FROM "customer" WHERE ("region" = $4)))`,
+			[]interface{}{10, `north`, 2014, `north`},
+		},
+		{
+			Statement{
+				Type:     Select,
+				Table:    `sale`,
+				Fields:   []interface{}{`region`},
+				Distinct: true,
+				Where:    []interface{}{db.Cond{`year`: 2014}},
+				OrderBy:  []interface{}{`region`},
+			},
+			`SELECT DISTINCT "region" FROM "sale" WHERE ("year" = $1) ORDER BY "region" ASC`,
+			[]interface{}{2014},
+		},
+		{
+			Statement{
+				Type:     Count,
+				Table:    `sale`,
+				Fields:   []interface{}{`region`, `year`},
+				Distinct: true,
+				Where:    []interface{}{db.Cond{`year >`: 2010}},
+			},
+			`SELECT count(1) AS total FROM (SELECT DISTINCT "region", "year" FROM "sale" WHERE ("year" > $1)) AS "distinct_rows"`,
+			[]interface{}{2010},
+		},
+		{
+			Statement{
+				Type:    Count,
+				Table:   `sale`,
+				Fields:  []interface{}{`region`, db.Sum(`total`)},
+				Where:   []interface{}{db.Cond{`year`: 2014}},
+				GroupBy: []interface{}{`region`},
+				Having:  []interface{}{db.Cond{`sum_total >`: 100}},
+			},
+			`SELECT count(1) AS total FROM (SELECT "region", sum("total") AS "sum_total" FROM "sale" WHERE ("year" = $1) GROUP BY "region" HAVING (sum("total") > $2)) AS "grouped_rows"`,
+			[]interface{}{2014, 100},
+		},
+		{
+			Statement{
+				Type:  Count,
+				Table: `sale`,
+				Joins: []Join{{Kind: InnerJoin, Table: `customer`, On: []interface{}{`sale.customer_id = customer.id`}}},
+			},
+			`SELECT count(1) AS total FROM "sale" JOIN "customer" ON ((sale.customer_id = customer.id))`,
+			[]interface{}{},
+		},
+		{
+			Statement{
+				Type:       Delete,
+				Table:      `translation`,
+				Where:      []interface{}{db.ID(`es`, `hello`)},
+				PrimaryKey: []string{`lang`, `word`},
+			},
+			`DELETE FROM "translation" WHERE (("lang" = $1 AND "word" = $2))`,
+			[]interface{}{`es`, `hello`},
+		},
+		{
+			Statement{
+				Type:    Update,
+				Table:   `artist`,
+				Columns: []string{`name`},
+				Values:  []interface{}{`Satoshi Kon`},
+				Where:   []interface{}{db.Cond{`id`: 1}},
+			},
+			`UPDATE "artist" SET "name" = $1 WHERE ("id" = $2)`,
+			[]interface{}{`Satoshi Kon`, 1},
+		},
+		{
+			Statement{
+				Type:    Select,
+				Table:   `artist`,
+				Fields:  []interface{}{`a.*`, `a.name AS artist name`},
+				Where:   []interface{}{db.Cond{`a.name ilike`: `%kon%`, `"id" not  in`: []int{1}}},
+				OrderBy: []interface{}{`-a.name`},
+			},
+			`SELECT "a".*, "a"."name" AS "artist name" FROM "artist" WHERE (("""id""" NOT IN ($1) AND "a"."name" ILIKE $2)) ORDER BY "a"."name" DESC`,
+			[]interface{}{1, `%kon%`},
+		},
+		{
+			Statement{
+				Type:  Select,
+				Table: `artist`,
+				Where: []interface{}{
+					db.Cond{`born`: nil, `died IS NOT NULL`: true, `id between`: []int{1, 9}},
+					db.Cond{`id NOT BETWEEN`: [2]int{3, 4}, `id in`: []int{}, `id not in`: []int{}},
+					db.Cond{`name REGEXP`: `^K`, `name != `: []string{`Kon`}, `name NOT LIKE`: `%x`},
+				},
+			},
+			`SELECT * FROM "artist" WHERE (("born" IS NULL AND "died" IS NOT NULL AND "id" BETWEEN $1 AND $2) AND ("id" NOT BETWEEN $3 AND $4 AND 1 = 0 AND 1 = 1) AND ("name" NOT IN ($5) AND "name" NOT LIKE $6 AND "name" REGEXP $7))`,
+			[]interface{}{1, 9, 3, 4, `Kon`, `%x`, `^K`},
+		},
+		{
+			Statement{
+				Type:    Select,
+				Table:   `artist`,
+				Fields:  []interface{}{`id`, db.Raw{Value: `lower(name) AS name`}},
+				Where:   []interface{}{db.Raw{Value: `lower(name) = ?`, Args: []interface{}{`kon`}}, db.Cond{`born <`: db.Raw{Value: `NOW()`}, `id IN`: db.Raw{Value: `SELECT id FROM b WHERE x = ?`, Args: []interface{}{2}}}},
+				OrderBy: []interface{}{db.Raw{Value: `random()`}, `-id`},
+			},
+			`SELECT "id", lower(name) AS name FROM "artist" WHERE ((lower(name) = $1) AND ("born" < NOW() AND "id" IN (SELECT id FROM b WHERE x = $2))) ORDER BY random(), "id" DESC`,
+			[]interface{}{`kon`, 2},
+		},
+		{
+			Statement{
+				Type:    Update,
+				Table:   `artist`,
+				Columns: []string{`name`, `updated_at`},
+				Values:  []interface{}{`Kon`, db.Raw{Value: `NOW()`}},
+				Where:   []interface{}{db.Cond{`id`: 1}},
+			},
+			`UPDATE "artist" SET "name" = $1, "updated_at" = NOW() WHERE ("id" = $2)`,
+			[]interface{}{`Kon`, 1},
+		},
+		{
+			Statement{
+				Type:  Delete,
+				Table: `artist`,
+				Where: []interface{}{db.Not{db.Or{db.Cond{`id`: 1}, db.Not{db.Cond{`id >`: 5}}}}, db.Not{}},
+			},
+			`DELETE FROM "artist" WHERE (NOT (("id" = $1 OR NOT ("id" > $2))))`,
+			[]interface{}{1, 5},
+		},
+		{
+			Statement{Type: Delete, Table: `artist`, Where: []interface{}{db.And{}}},
+			`DELETE FROM "artist"`,
+			[]interface{}{},
+		},
+		{
+			Statement{Type: Truncate, Table: `artist`},
+			`TRUNCATE TABLE "artist"`,
+			[]interface{}{},
+		},
+		{
+			*RawQuery(`SELECT * FROM artist WHERE id = ? OR name = ?`, 1, `Kon`),
+			`SELECT * FROM artist WHERE id = $1 OR name = $2`,
+			[]interface{}{1, `Kon`},
+		},
+	}
+
+	for _, test := range tests {
+		sql, args, err := test.stmt.Compile(testDialect{})
+		if err != nil {
+			t.Fatalf(`%s: %q`, test.sql, err)
+		}
+		if sql != test.sql {
+			t.Fatalf("Expecting:\n%s\nGot:\n%s", test.sql, sql)
+		}
+		if reflect.DeepEqual(args, test.args) == false {
+			t.Fatalf(`%s: Expecting arguments %v, got %v.`, test.sql, test.args, args)
+		}
+	}
+}
+
+func TestSplit(t *testing.T) {
+	stmt := &Statement{
+		Type:    Insert,
+		Table:   `artist`,
+		Columns: []string{`name`, `born`},
+		Rows: [][]interface{}{
+			{`Kon`, 1963},
+			{`Miyazaki`, 1941},
+			{`Takahata`, 1935},
+			{`Hosoda`, 1967},
+			{`Shinkai`, 1973},
+		},
+	}
+
+	stmts := stmt.Split(testDialect{})
+
+	if len(stmts) != 3 {
+		t.Fatalf(`Expecting 3 statements, got %d.`, len(stmts))
+	}
+
+	sql, args, err := stmts[0].Compile(testDialect{})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if sql != `INSERT INTO "artist" ("name", "born") VALUES ($1, $2), ($3, $4)` {
+		t.Fatalf(`Unexpected SQL %s.`, sql)
+	}
+
+	if reflect.DeepEqual(args, []interface{}{`Kon`, 1963, `Miyazaki`, 1941}) == false {
+		t.Fatalf(`Unexpected arguments %v.`, args)
+	}
+
+	if sql, _, _ = stmts[2].Compile(testDialect{}); sql != `INSERT INTO "artist" ("name", "born") VALUES ($1, $2)` {
+		t.Fatalf(`Unexpected SQL %s.`, sql)
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	var err error
+
+	if _, _, err = (&Statement{Type: Select}).Compile(testDialect{}); err == nil {
+		t.Fatalf(`Expecting an error for a missing table.`)
+	}
+
+	if _, _, err = (&Statement{Type: Update, Table: `artist`}).Compile(testDialect{}); err == nil {
+		t.Fatalf(`Expecting an error for an update without values.`)
+	}
+
+	if _, _, err = (&Statement{Type: Insert, Table: `artist`, Columns: []string{`name`}}).Compile(testDialect{}); err == nil {
+		t.Fatalf(`Expecting an error for mismatched columns and values.`)
+	}
+
+	stmt := &Statement{Type: Select, Table: `artist`, Where: []interface{}{db.Cond{`id; DROP TABLE artist; --`: 1}}}
+	_, _, err = stmt.Compile(testDialect{})
+	if qerr, ok := err.(*db.QueryError); ok == false || qerr.Err != db.ErrUnknownOperator {
+		t.Fatalf(`Expecting an unknown operator error, got %v.`, err)
+	}
+
+	// db.Func names are written as is.
+	stmt.Where = []interface{}{db.Cond{`id`: db.Func{Name: `@@`, Args: `kon`}}}
+	if _, _, err = stmt.Compile(testDialect{}); err != nil {
+		t.Fatalf(`Expecting no error for a db.Func, got %v.`, err)
+	}
+
+	for _, cond := range []db.Cond{
+		{`id BETWEEN`: 1},
+		{`id BETWEEN`: []int{1, 2, 3}},
+		{`name LIKE`: 1},
+		{`id >`: []int{1, 2}},
+		{`id <`: nil},
+	} {
+		stmt.Where = []interface{}{cond}
+		_, _, err = stmt.Compile(testDialect{})
+		if qerr, ok := err.(*db.QueryError); ok == false || qerr.Err != db.ErrInvalidConditionValue {
+			t.Fatalf(`Expecting an invalid condition value error for %v, got %v.`, cond, err)
+		}
+	}
+
+	// Subqueries must be SELECT statements of the same dialect.
+	for _, sub := range []testSubquery{
+		{Statement{Type: Select, Table: `artist`}, otherDialect{}},
+		{Statement{Type: Delete, Table: `artist`}, testDialect{}},
+	} {
+		stmt.Where = []interface{}{db.Cond{`id`: sub}}
+		_, _, err = stmt.Compile(testDialect{})
+		if qerr, ok := err.(*db.QueryError); ok == false || qerr.Err != db.ErrInvalidConditionValue {
+			t.Fatalf(`Expecting an invalid condition value error for %v, got %v.`, sub, err)
+		}
+	}
+
+	stmt.Where = nil
+	stmt.Fields = []interface{}{db.Aggregate{Func: `MEDIAN`, Field: `born`}}
+	_, _, err = stmt.Compile(testDialect{})
+	if qerr, ok := err.(*db.QueryError); ok == false || qerr.Err != db.ErrUnknownAggregate {
+		t.Fatalf(`Expecting an unknown aggregate error, got %v.`, err)
+	}
+
+	stmt.Fields = nil
+	stmt.Where = []interface{}{db.ID(1)}
+	if _, _, err = stmt.Compile(testDialect{}); err != db.ErrMissingPrimaryKey {
+		t.Fatalf(`Expecting db.ErrMissingPrimaryKey, got %v.`, err)
+	}
+
+	stmt.PrimaryKey = []string{`id`}
+	stmt.Where = []interface{}{db.ID(1, 2)}
+	_, _, err = stmt.Compile(testDialect{})
+	if qerr, ok := err.(*db.QueryError); ok == false || qerr.Err != db.ErrInvalidConditionValue {
+		t.Fatalf(`Expecting an invalid condition value error, got %v.`, err)
+	}
+
+	stmt.Where = nil
+	stmt.OrderBy = []interface{}{``}
+	_, _, err = stmt.Compile(testDialect{})
+	if qerr, ok := err.(*db.QueryError); ok == false || qerr.Err != db.ErrInvalidIdentifier {
+		t.Fatalf(`Expecting an invalid identifier error, got %v.`, err)
+	}
+}
@@ -0,0 +1,279 @@
+/*
+  Copyright (c) 2012-2014 José Carlos Nieto, https://menteslibres.net/xiam
+
+  Permission is hereby granted, free of charge, to any person obtaining
+  a copy of this software and associated documentation files (the
+  "Software"), to deal in the Software without restriction, including
+  without limitation the rights to use, copy, modify, merge, publish,
+  distribute, sublicense, and/or sell copies of the Software, and to
+  permit persons to whom the Software is furnished to do so, subject to
+  the following conditions:
+
+  The above copyright notice and this permission notice shall be
+  included in all copies or substantial portions of the Software.
+
+  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+  EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+  MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+  NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+  LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+  OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+  WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+
+package sqlgen
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"upper.io/db"
+)
+
+// Compiles conditions into a SQL expression, terms are joined by AND.
+func (self *compiler) conditions(terms []interface{}) string {
+	return self.compile(terms)
+}
+
+func (self *compiler) compile(term interface{}) string {
+	switch t := term.(type) {
+	case []interface{}:
+		return self.join(t, `AND`)
+	case db.Or:
+		return self.join(t, `OR`)
+	case db.And:
+		return self.join(t, `AND`)
+	case db.Not:
+		if s := self.join(t, `AND`); s != "" {
+			return self.operator(`NOT`) + ` ` + s
+		}
+		return ""
+	case db.Cond:
+		return self.cond(t)
+	case db.Key:
+		return self.key(t)
+	case db.Raw:
+		return `(` + self.raw(t) + `)`
+	}
+	return ""
+}
+
+// Joins the compiled terms with the given logical operator.
+func (self *compiler) join(terms []interface{}, op string) string {
+	sql := []string{}
+
+	for i := range terms {
+		if s := self.compile(terms[i]); s != "" {
+			sql = append(sql, s)
+		}
+	}
+
+	if len(sql) > 0 {
+		return `(` + strings.Join(sql, ` `+self.operator(op)+` `) + `)`
+	}
+
+	return ""
+}
+
+// Quotes the column of a condition, names of aggregates are replaced by the
+// aggregate.
+func (self *compiler) column(name string) string {
+	if expr, ok := self.aggregates[name]; ok {
+		return expr
+	}
+	return self.identifier(name)
+}
+
+// Compiles a primary key into equalities on the primary key columns.
+func (self *compiler) key(key db.Key) string {
+	if len(self.primaryKey) == 0 {
+		self.fail(db.ErrMissingPrimaryKey)
+		return ""
+	}
+
+	if len(key) != len(self.primaryKey) {
+		self.fail(&db.QueryError{Value: strings.Join(self.primaryKey, `, `), Err: db.ErrInvalidConditionValue})
+		return ""
+	}
+
+	cond := make(db.Cond, len(key))
+	for i := range key {
+		cond[self.primaryKey[i]] = key[i]
+	}
+
+	return self.cond(cond)
+}
+
+func (self *compiler) cond(cond db.Cond) string {
+	keys := make([]string, 0, len(cond))
+
+	// Sorting keys, so the same conditions always produce the same SQL.
+	for key := range cond {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	str := make([]string, 0, len(keys))
+
+	for _, key := range keys {
+		chunks := strings.SplitN(strings.TrimSpace(key), ` `, 2)
+
+		// Default operator.
+		op := `=`
+
+		if len(chunks) > 1 {
+			// User has defined a different operator.
+			op = strings.TrimSpace(chunks[1])
+		}
+
+		column := self.column(chunks[0])
+
+		switch value := cond[key].(type) {
+		case db.Func:
+			// The name of a db.Func is written as is.
+			str = append(str, column+` `+value.Name+` `+self.values(value.Args))
+		default:
+			str = append(str, self.compare(key, column, normalize(op), value))
+		}
+	}
+
+	switch len(str) {
+	case 0:
+		return ""
+	case 1:
+		return str[0]
+	}
+
+	return `(` + strings.Join(str, ` `+self.operator(`AND`)+` `) + `)`
+}
+
+// Compiles a condition on a quoted column, key is the db.Cond key the
+// condition comes from.
+func (self *compiler) compare(key string, column string, op string, value interface{}) string {
+	if raw, ok := value.(db.Raw); ok {
+		switch op {
+		case `IS NULL`, `IS NOT NULL`:
+			return column + ` ` + op
+		case `IN`, `NOT IN`:
+			return column + ` ` + op + ` (` + self.raw(raw) + `)`
+		}
+		return column + ` ` + self.operator(op) + ` ` + self.raw(raw)
+	}
+
+	if sub, ok := value.(Subquery); ok {
+		switch op {
+		case `=`, `IS`:
+			op = `IN`
+		case `!=`, `<>`, `IS NOT`:
+			op = `NOT IN`
+		}
+		switch op {
+		case `IN`, `NOT IN`:
+			return column + ` ` + op + ` ` + self.subquery(key, sub)
+		}
+		return column + ` ` + self.operator(op) + ` ` + self.subquery(key, sub)
+	}
+
+	_, isSlice := self.slice(value)
+
+	// A nil or a slice value without an explicit operator.
+	switch op {
+	case `=`, `IS`:
+		if value == nil {
+			op = `IS NULL`
+		} else if isSlice {
+			op = `IN`
+		}
+	case `!=`, `<>`, `IS NOT`:
+		if value == nil {
+			op = `IS NOT NULL`
+		} else if isSlice {
+			op = `NOT IN`
+		}
+	}
+
+	switch op {
+	case `IS NULL`, `IS NOT NULL`:
+		return column + ` ` + op
+	case `IN`, `NOT IN`:
+		args := self.interfaceArgs(value)
+		if len(args) == 0 {
+			// IN () is not valid SQL, an empty list matches nothing.
+			if op == `IN` {
+				return `1 ` + self.operator(`=`) + ` 0`
+			}
+			return `1 ` + self.operator(`=`) + ` 1`
+		}
+		placeholders := make([]string, len(args))
+		for i := range args {
+			placeholders[i] = self.bind(args[i])
+		}
+		return column + ` ` + op + ` (` + strings.Join(placeholders, `, `) + `)`
+	case `BETWEEN`, `NOT BETWEEN`:
+		args := self.interfaceArgs(value)
+		if isSlice == false || len(args) != 2 {
+			self.fail(&db.QueryError{Value: key, Err: db.ErrInvalidConditionValue})
+			return ""
+		}
+		return column + ` ` + op + ` ` + self.bind(args[0]) + ` AND ` + self.bind(args[1])
+	case `LIKE`, `ILIKE`, `REGEXP`, `NOT LIKE`, `NOT ILIKE`, `NOT REGEXP`:
+		pattern, ok := value.(string)
+		if ok == false {
+			self.fail(&db.QueryError{Value: key, Err: db.ErrInvalidConditionValue})
+			return ""
+		}
+		return self.dialect.Match(column, op, pattern, self.bind)
+	}
+
+	if isSlice || value == nil {
+		self.fail(&db.QueryError{Value: key, Err: db.ErrInvalidConditionValue})
+		return ""
+	}
+
+	return column + ` ` + self.operator(op) + ` ` + self.bind(self.dialect.Value(value))
+}
+
+// Binds a value and returns its placeholder within parentheses, slices are
+// bound as a list of values.
+func (self *compiler) values(value interface{}) string {
+	args := self.interfaceArgs(value)
+
+	placeholders := make([]string, len(args))
+
+	for i := range args {
+		placeholders[i] = self.bind(args[i])
+	}
+
+	return `(` + strings.Join(placeholders, `, `) + `)`
+}
+
+// Returns the reflected value of a slice value, a []byte is not a slice but a
+// single value.
+func (self *compiler) slice(value interface{}) (reflect.Value, bool) {
+	if value == nil {
+		return reflect.Value{}, false
+	}
+	if _, ok := value.([]byte); ok {
+		return reflect.Value{}, false
+	}
+	value_v := reflect.ValueOf(value)
+	return value_v, value_v.Kind() == reflect.Slice || value_v.Kind() == reflect.Array
+}
+
+// Converts a value or a slice of values into arguments for the driver.
+func (self *compiler) interfaceArgs(value interface{}) []interface{} {
+	if value == nil {
+		return nil
+	}
+
+	if value_v, ok := self.slice(value); ok {
+		args := make([]interface{}, value_v.Len())
+		for i := range args {
+			args[i] = self.dialect.Value(value_v.Index(i).Interface())
+		}
+		return args
+	}
+
+	return []interface{}{self.dialect.Value(value)}
+}
@@ -0,0 +1,244 @@
+/*
+  Copyright (c) 2012-2014 José Carlos Nieto, https://menteslibres.net/xiam
+
+  Permission is hereby granted, free of charge, to any person obtaining
+  a copy of this software and associated documentation files (the
+  "Software"), to deal in the Software without restriction, including
+  without limitation the rights to use, copy, modify, merge, publish,
+  distribute, sublicense, and/or sell copies of the Software, and to
+  permit persons to whom the Software is furnished to do so, subject to
+  the following conditions:
+
+  The above copyright notice and this permission notice shall be
+  included in all copies or substantial portions of the Software.
+
+  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+  EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+  MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+  NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+  LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+  OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+  WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+
+package sqlutil
+
+import (
+	"context"
+	"database/sql"
+	"reflect"
+	"upper.io/db"
+	"upper.io/db/util/sqlgen"
+)
+
+// Database of a SQL adapter, tables and result sets run their statements on
+// it.
+type Source interface {
+	db.Database
+
+	// Returns the dialect statements are compiled with.
+	Dialect() sqlgen.Dialect
+
+	// Executes a statement that doesn't return rows.
+	ExecStatement(*sqlgen.Statement) (sql.Result, error)
+
+	// Executes a statement that returns rows.
+	QueryStatement(*sqlgen.Statement) (*sql.Rows, error)
+
+	// Returns the context statements run within.
+	Context() context.Context
+}
+
+// Returns the fetcher that maps the rows of the table.
+func (self *T) fetcher() Fetcher {
+	if self.Fetcher != nil {
+		return self.Fetcher
+	}
+	return self
+}
+
+// Creates a filter with the given terms.
+func (self *T) Find(terms ...interface{}) db.Result {
+	return &Result{
+		table:  self,
+		source: self.Source,
+		query: sqlgen.Statement{
+			Type:       sqlgen.Select,
+			Table:      self.Name(),
+			Where:      terms,
+			PrimaryKey: self.PrimaryKeys,
+		},
+	}
+}
+
+// Fetches the item with the given primary key value or db.Key.
+func (self *T) Get(id interface{}, dst interface{}) error {
+	key, ok := id.(db.Key)
+	if ok == false {
+		key = db.ID(id)
+	}
+	return self.Find(key).One(dst)
+}
+
+// Deletes all the rows within the collection.
+func (self *T) Truncate() error {
+	_, err := self.Source.ExecStatement(&sqlgen.Statement{
+		Type:  sqlgen.Truncate,
+		Table: self.Name(),
+	})
+
+	return err
+}
+
+// Appends an item (map or struct) into the collection and returns the ID the
+// driver reports for it.
+func (self *T) Append(item interface{}) (interface{}, error) {
+	fields, values, err := self.FieldValues(item, self.ConvertFn)
+
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := self.Source.ExecStatement(&sqlgen.Statement{
+		Type:    sqlgen.Insert,
+		Table:   self.Name(),
+		Columns: fields,
+		Values:  values,
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	// Last inserted ID could be zero too.
+	id, _ := res.LastInsertId()
+
+	// A pointer gets the row as it was stored, including the values the
+	// database generated.
+	if reflect.TypeOf(item).Kind() == reflect.Ptr {
+		// Keys are told from the values before their conversion, which turns
+		// zero values into something else.
+		_, raw, _ := self.FieldValues(item, func(value interface{}) interface{} { return value })
+		if key := self.InsertedKey(fields, raw, id); key != nil {
+			if err = self.Find(key).One(item); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return id, nil
+}
+
+// Appends the items of a slice of maps or structs into the collection with
+// multi-row INSERT statements, split to stay within the driver's limit of
+// arguments. Statements are not atomic as a whole unless they run within a
+// transaction.
+//
+// IDs are the primary key values of items that carry them, otherwise they are
+// nil unless the table has ConsecutiveIDs.
+func (self *T) AppendAll(items interface{}) ([]interface{}, error) {
+	stmts, err := self.InsertStatements(self.Name(), items, self.ConvertFn)
+
+	if err != nil {
+		return nil, err
+	}
+
+	ids := []interface{}{}
+
+	for _, stmt := range stmts {
+		for _, batch := range stmt.Split(self.Source.Dialect()) {
+			res, err := self.Source.ExecStatement(batch)
+			if err != nil {
+				return ids, err
+			}
+
+			// Rows that carry their own primary key keep it.
+			if keys := self.keyColumns(batch.Columns); keys != nil {
+				for _, row := range batch.Rows {
+					ids = append(ids, rowKey(row, keys))
+				}
+				continue
+			}
+
+			if self.ConsecutiveIDs == false {
+				for range batch.Rows {
+					ids = append(ids, nil)
+				}
+				continue
+			}
+
+			// Rows get IDs up to the last inserted one, or from the first one.
+			id, _ := res.LastInsertId()
+
+			if self.FirstInsertID == false {
+				id = id - int64(len(batch.Rows)-1)
+			}
+
+			for i := range batch.Rows {
+				ids = append(ids, id+int64(i))
+			}
+		}
+	}
+
+	return ids, nil
+}
+
+// Returns the positions of the primary key columns within the given columns,
+// or nil if any of them is missing.
+func (self *T) keyColumns(columns []string) []int {
+	if len(self.PrimaryKeys) == 0 {
+		return nil
+	}
+
+	keys := make([]int, len(self.PrimaryKeys))
+
+	for i := range self.PrimaryKeys {
+		keys[i] = -1
+		for j := range columns {
+			if columns[j] == self.PrimaryKeys[i] {
+				keys[i] = j
+			}
+		}
+		if keys[i] < 0 {
+			return nil
+		}
+	}
+
+	return keys
+}
+
+// Returns the primary key value of a row, or a db.Key for composite keys.
+func rowKey(row []interface{}, keys []int) interface{} {
+	if len(keys) == 1 {
+		return row[keys[0]]
+	}
+
+	key := make(db.Key, len(keys))
+
+	for i := range keys {
+		key[i] = row[keys[i]]
+	}
+
+	return key
+}
+
+// Inserts an item, or updates the row that has the values of the conditions if
+// there's one already. The columns of the conditions must have a unique
+// constraint.
+func (self *T) Upsert(cond db.Cond, item interface{}) error {
+	fields, values, keys, err := self.UpsertValues(cond, item, self.ConvertFn)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = self.Source.ExecStatement(&sqlgen.Statement{
+		Type:       sqlgen.Insert,
+		Table:      self.Name(),
+		Columns:    fields,
+		Values:     values,
+		OnConflict: keys,
+	})
+
+	return err
+}
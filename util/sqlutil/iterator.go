@@ -0,0 +1,91 @@
+/*
+  Copyright (c) 2012-2014 José Carlos Nieto, https://menteslibres.net/xiam
+
+  Permission is hereby granted, free of charge, to any person obtaining
+  a copy of this software and associated documentation files (the
+  "Software"), to deal in the Software without restriction, including
+  without limitation the rights to use, copy, modify, merge, publish,
+  distribute, sublicense, and/or sell copies of the Software, and to
+  permit persons to whom the Software is furnished to do so, subject to
+  the following conditions:
+
+  The above copyright notice and this permission notice shall be
+  included in all copies or substantial portions of the Software.
+
+  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+  EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+  MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+  NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+  LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+  OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+  WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+
+package sqlutil
+
+import (
+	"context"
+	"database/sql"
+	"upper.io/db"
+	"upper.io/db/util"
+)
+
+// Copies rows from a *sql.Rows cursor into maps or structs.
+type Fetcher interface {
+	FetchRow(interface{}, *sql.Rows) error
+	FetchRows(interface{}, *sql.Rows) error
+}
+
+// Iterates over the rows returned by a raw query.
+type Iterator struct {
+	fetcher Fetcher
+	ctx     context.Context
+	cursor  *sql.Rows
+}
+
+// Creates an iterator that uses the given fetcher to map rows from cursor.
+func NewIterator(ctx context.Context, fetcher Fetcher, cursor *sql.Rows) *Iterator {
+	return &Iterator{fetcher, ctx, cursor}
+}
+
+// Fetches the next row from the cursor.
+func (self *Iterator) Next(dst interface{}) error {
+	if self.cursor == nil {
+		return db.ErrNoMoreRows
+	}
+
+	err := self.fetcher.FetchRow(dst, self.cursor)
+
+	if err != nil {
+		self.Close()
+	}
+
+	return util.ContextError(self.ctx, err)
+}
+
+// Fetches only one row from the cursor and closes it.
+func (self *Iterator) One(dst interface{}) error {
+	defer self.Close()
+	return self.Next(dst)
+}
+
+// Dumps all rows into a pointer to an slice of structs or maps.
+func (self *Iterator) All(dst interface{}) error {
+	if self.cursor == nil {
+		return db.ErrNoMoreRows
+	}
+
+	defer self.Close()
+
+	return util.ContextError(self.ctx, self.fetcher.FetchRows(dst, self.cursor))
+}
+
+// Closes the cursor.
+func (self *Iterator) Close() error {
+	var err error
+	if self.cursor != nil {
+		err = self.cursor.Close()
+		self.cursor = nil
+	}
+	return err
+}
@@ -27,24 +27,34 @@ import (
 	"database/sql"
 	"menteslibres.net/gosexy/to"
 	"reflect"
+	"sort"
 	"strings"
 	"upper.io/db"
 	"upper.io/db/util"
+	"upper.io/db/util/sqlgen"
 )
 
 type T struct {
-	PrimaryKey  string
+	PrimaryKeys []string
 	ColumnTypes map[string]reflect.Kind
 	util.C
+	// Source the table belongs to.
+	Source Source
+	// Maps rows into maps or structs, the table itself does if nil.
+	Fetcher Fetcher
+	// Converts values into the representation the database takes.
+	ConvertFn func(interface{}) interface{}
+	// True if the rows a statement inserts get consecutive IDs, which is the
+	// case for databases with a single writer.
+	ConsecutiveIDs bool
+	// True if LastInsertId() reports the ID of the first row a statement
+	// inserts instead of the last one.
+	FirstInsertID bool
 }
 
-type QueryChunks struct {
-	Fields     []string
-	Limit      string
-	Offset     string
-	Sort       string
-	Conditions string
-	Arguments  []interface{}
+// Returns the columns of the table's primary key, in order.
+func (self *T) PrimaryKey() []string {
+	return self.PrimaryKeys
 }
 
 func (self *T) ColumnLike(s string) string {
@@ -57,9 +67,17 @@ func (self *T) ColumnLike(s string) string {
 }
 
 func (self *T) fetchResult(item_t reflect.Type, rows *sql.Rows, columns []string) (reflect.Value, error) {
-	var item reflect.Value
-	var err error
+	values, err := scanRow(rows, columns)
+
+	if err != nil {
+		return reflect.Value{}, err
+	}
 
+	return self.buildResult(item_t, values, columns)
+}
+
+// Scans the current row of rows, NULL values are nil.
+func scanRow(rows *sql.Rows, columns []string) ([]*sql.RawBytes, error) {
 	expecting := len(columns)
 
 	// Allocating results.
@@ -70,6 +88,27 @@ func (self *T) fetchResult(item_t reflect.Type, rows *sql.Rows, columns []string
 		scanArgs[i] = &values[i]
 	}
 
+	if err := rows.Scan(scanArgs...); err != nil {
+		return nil, err
+	}
+
+	return values, nil
+}
+
+// Converts the value of a column to the type of the column.
+func (self *T) columnValue(column string, svalue string) reflect.Value {
+	if _, ok := self.ColumnTypes[column]; ok == true {
+		v, _ := to.Convert(svalue, self.ColumnTypes[column])
+		return reflect.ValueOf(v)
+	}
+	v, _ := to.Convert(svalue, reflect.String)
+	return reflect.ValueOf(v)
+}
+
+// Builds a map or a struct with the scanned values of a row.
+func (self *T) buildResult(item_t reflect.Type, values []*sql.RawBytes, columns []string) (reflect.Value, error) {
+	var item reflect.Value
+
 	switch item_t.Kind() {
 	case reflect.Map:
 		item = reflect.MakeMap(item_t)
@@ -79,12 +118,6 @@ func (self *T) fetchResult(item_t reflect.Type, rows *sql.Rows, columns []string
 		return item, db.ErrExpectingMapOrStruct
 	}
 
-	err = rows.Scan(scanArgs...)
-
-	if err != nil {
-		return item, err
-	}
-
 	// Range over row values.
 	for i, value := range values {
 
@@ -94,15 +127,7 @@ func (self *T) fetchResult(item_t reflect.Type, rows *sql.Rows, columns []string
 			// Value as string.
 			svalue := string(*value)
 
-			var cv reflect.Value
-
-			if _, ok := self.ColumnTypes[column]; ok == true {
-				v, _ := to.Convert(svalue, self.ColumnTypes[column])
-				cv = reflect.ValueOf(v)
-			} else {
-				v, _ := to.Convert(svalue, reflect.String)
-				cv = reflect.ValueOf(v)
-			}
+			cv := self.columnValue(column, svalue)
 
 			switch item_t.Kind() {
 			// Destination is a map.
@@ -205,6 +230,61 @@ func (self *T) FetchRow(dst interface{}, rows *sql.Rows) error {
 	return nil
 }
 
+/*
+	Copies the next row of *sql.Rows into the map or struct given by the pointer
+	dst, like FetchRow, and returns the values the row has for the given key
+	columns.
+*/
+func (self *T) FetchRowKey(dst interface{}, rows *sql.Rows, key []string) (db.Key, error) {
+
+	dstv := reflect.ValueOf(dst)
+
+	if dstv.IsNil() || dstv.Kind() != reflect.Ptr {
+		return nil, db.ErrExpectingPointer
+	}
+
+	item_v := dstv.Elem()
+
+	columns, err := GetRowColumns(rows)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if rows.Next() == false {
+		if err = rows.Err(); err != nil {
+			return nil, err
+		}
+		return nil, db.ErrNoMoreRows
+	}
+
+	values, err := scanRow(rows, columns)
+
+	if err != nil {
+		return nil, err
+	}
+
+	item, err := self.buildResult(item_v.Type(), values, columns)
+
+	if err != nil {
+		return nil, err
+	}
+
+	item_v.Set(reflect.Indirect(item))
+
+	keys := make(db.Key, len(key))
+
+	for i := range key {
+		for j := range columns {
+			if columns[j] == strings.ToLower(key[i]) && values[j] != nil {
+				keys[i] = self.columnValue(columns[j], string(*values[j])).Interface()
+			}
+		}
+	}
+
+	return keys, nil
+}
+
 /*
 	Copies *sql.Rows into the slice of maps or structs given by the pointer dst.
 */
@@ -247,6 +327,75 @@ func (self *T) FetchRows(dst interface{}, rows *sql.Rows) error {
 
 	rows.Close()
 
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	dstv.Elem().Set(slicev)
+
+	return nil
+}
+
+// Dumps the first column of every row into a pointer to a slice of any type,
+// like *[]string. NULL values are the zero value of the type.
+func (self *T) FetchValues(dst interface{}, rows *sql.Rows) error {
+	dstv := reflect.ValueOf(dst)
+
+	if dstv.Kind() != reflect.Ptr || dstv.IsNil() {
+		return db.ErrExpectingPointer
+	}
+
+	if dstv.Elem().Kind() != reflect.Slice {
+		return db.ErrExpectingSlicePointer
+	}
+
+	columns, err := GetRowColumns(rows)
+
+	if err != nil {
+		return err
+	}
+
+	item_t := dstv.Elem().Type().Elem()
+	slicev := reflect.MakeSlice(dstv.Elem().Type(), 0, 0)
+
+	for rows.Next() {
+		values, err := scanRow(rows, columns)
+
+		if err != nil {
+			return err
+		}
+
+		item := reflect.Zero(item_t)
+
+		if values[0] != nil {
+			svalue := string(*values[0])
+
+			cv := self.columnValue(columns[0], svalue)
+			if cv.Type() != item_t && item_t.Kind() != reflect.Interface {
+				cv, _ = util.StringToType(svalue, item_t)
+			}
+
+			if cv.IsValid() {
+				switch {
+				case cv.Type().AssignableTo(item_t):
+					item = cv
+				case cv.Type().ConvertibleTo(item_t):
+					item = cv.Convert(item_t)
+				default:
+					return db.ErrUnsupportedDestination
+				}
+			}
+		}
+
+		slicev = reflect.Append(slicev, item)
+	}
+
+	rows.Close()
+
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
 	dstv.Elem().Set(slicev)
 
 	return nil
@@ -308,6 +457,11 @@ func (self *T) FieldValues(item interface{}, convertFn func(interface{}) interfa
 				continue
 			}
 
+			// Relations are not columns.
+			if _, ok, _ := util.ParseRelation(field); ok == true {
+				continue
+			}
+
 			if fieldName == "" {
 				fieldName = self.ColumnLike(field.Name)
 			}
@@ -341,10 +495,21 @@ func (self *T) FieldValues(item interface{}, convertFn func(interface{}) interfa
 		fields = make([]string, nfields)
 		mkeys := item_v.MapKeys()
 
+		// Sorting keys, so maps with the same keys always produce the same
+		// columns.
+		sort.Slice(mkeys, func(i, j int) bool {
+			return to.String(mkeys[i].Interface()) < to.String(mkeys[j].Interface())
+		})
+
 		for i, key_v := range mkeys {
 			valv := item_v.MapIndex(key_v)
 			fields[i] = self.ColumnLike(to.String(key_v.Interface()))
-			values[i] = convertFn(valv.Interface())
+			if raw, ok := valv.Interface().(db.Raw); ok {
+				// Raw expressions are written as is.
+				values[i] = raw
+			} else {
+				values[i] = convertFn(valv.Interface())
+			}
 		}
 
 	default:
@@ -354,7 +519,225 @@ func (self *T) FieldValues(item interface{}, convertFn func(interface{}) interfa
 	return fields, values, nil
 }
 
-func NewQueryChunks() *QueryChunks {
-	self := &QueryChunks{}
-	return self
+// Returns the primary key of a row that was inserted with the given columns
+// and values: the values it has for the key columns or, for a single column
+// key it didn't set, the id the database generated. Returns nil if the key
+// can't be told.
+func (self *T) InsertedKey(fields []string, values []interface{}, lastInsertId int64) db.Key {
+	if len(self.PrimaryKeys) == 0 {
+		return nil
+	}
+
+	key := make(db.Key, len(self.PrimaryKeys))
+
+	for i := range self.PrimaryKeys {
+		for j := range fields {
+			if fields[j] == self.PrimaryKeys[i] && isZero(values[j]) == false {
+				key[i] = values[j]
+			}
+		}
+		if key[i] == nil {
+			if len(key) == 1 && lastInsertId > 0 {
+				return db.Key{lastInsertId}
+			}
+			return nil
+		}
+	}
+
+	return key
+}
+
+// Returns true if the value is nil or the zero value of its type.
+func isZero(value interface{}) bool {
+	if value == nil {
+		return true
+	}
+	return reflect.DeepEqual(value, reflect.Zero(reflect.TypeOf(value)).Interface())
+}
+
+// Builds the multi-row INSERT statements that append the items of a slice of
+// maps or structs to the table, consecutive items with the same columns share
+// a statement. Statements are not split by the dialect's argument limit.
+func (self *T) InsertStatements(table string, items interface{}, convertFn func(interface{}) interface{}) ([]*sqlgen.Statement, error) {
+	items_v := reflect.ValueOf(items)
+
+	if items_v.Kind() == reflect.Ptr {
+		items_v = items_v.Elem()
+	}
+
+	if items_v.Kind() != reflect.Slice {
+		return nil, db.ErrExpectingSliceMapStruct
+	}
+
+	stmts := []*sqlgen.Statement{}
+
+	var last *sqlgen.Statement
+
+	for i := 0; i < items_v.Len(); i++ {
+		fields, values, err := self.FieldValues(items_v.Index(i).Interface(), convertFn)
+		if err != nil {
+			return nil, err
+		}
+
+		if last == nil || reflect.DeepEqual(last.Columns, fields) == false {
+			last = &sqlgen.Statement{
+				Type:    sqlgen.Insert,
+				Table:   table,
+				Columns: fields,
+			}
+			stmts = append(stmts, last)
+		}
+
+		last.Rows = append(last.Rows, values)
+	}
+
+	return stmts, nil
+}
+
+// Returns the columns and values an upsert inserts, which are the fields of
+// the item plus the columns of the conditions the item lacks, and the columns
+// of the conditions. Conditions must be equalities on columns.
+func (self *T) UpsertValues(cond db.Cond, item interface{}, convertFn func(interface{}) interface{}) ([]string, []interface{}, []string, error) {
+	if len(cond) == 0 {
+		return nil, nil, nil, db.ErrMissingConditions
+	}
+
+	fields, values, err := self.FieldValues(item, convertFn)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	names := make([]string, 0, len(cond))
+	for name := range cond {
+		names = append(names, name)
+	}
+
+	// Sorting keys, so the same conditions always produce the same SQL.
+	sort.Strings(names)
+
+	keys := make([]string, 0, len(cond))
+
+	for _, key := range names {
+		value := cond[key]
+		chunks := strings.Fields(key)
+
+		if len(chunks) > 2 || (len(chunks) == 2 && chunks[1] != `=`) || value == nil {
+			return nil, nil, nil, &db.QueryError{Value: key, Err: db.ErrInvalidConditionValue}
+		}
+
+		column := self.ColumnLike(chunks[0])
+		keys = append(keys, column)
+
+		found := false
+		for i := range fields {
+			if fields[i] == column {
+				found = true
+				break
+			}
+		}
+
+		if found == false {
+			fields = append(fields, column)
+			values = append(values, convertFn(value))
+		}
+	}
+
+	return fields, values, keys, nil
+}
+
+// Applies the connection pool limits of the given settings to a *sql.DB.
+func SetPoolLimits(session *sql.DB, settings db.Settings) {
+	if settings.MaxOpenConns > 0 {
+		session.SetMaxOpenConns(settings.MaxOpenConns)
+	}
+	if settings.MaxIdleConns > 0 {
+		session.SetMaxIdleConns(settings.MaxIdleConns)
+	}
+	if settings.ConnMaxLifetime > 0 {
+		session.SetConnMaxLifetime(settings.ConnMaxLifetime)
+	}
+}
+
+// Returns the connection pool statistics of a *sql.DB.
+func PoolStats(session *sql.DB) db.Stats {
+	stats := session.Stats()
+	return db.Stats{
+		OpenConnections: stats.OpenConnections,
+		InUse:           stats.InUse,
+		Idle:            stats.Idle,
+	}
+}
+
+// Formats the rows returned by an EXPLAIN statement, one line per row.
+func ExplainRows(rows *sql.Rows) (string, error) {
+	columns, err := rows.Columns()
+	if err != nil {
+		return "", err
+	}
+
+	lines := []string{}
+
+	for rows.Next() {
+		values := make([]sql.NullString, len(columns))
+		pointers := make([]interface{}, len(columns))
+		for i := range values {
+			pointers[i] = &values[i]
+		}
+
+		if err = rows.Scan(pointers...); err != nil {
+			return "", err
+		}
+
+		if len(columns) == 1 {
+			lines = append(lines, values[0].String)
+			continue
+		}
+
+		fields := make([]string, len(columns))
+		for i := range columns {
+			fields[i] = columns[i] + `: ` + values[i].String
+		}
+		lines = append(lines, strings.Join(fields, `, `))
+	}
+
+	if err = rows.Err(); err != nil {
+		return "", err
+	}
+
+	return strings.Join(lines, "\n"), nil
+}
+
+// Adds a join to a SELECT statement once its conditions are given, see
+// db.Joiner.
+type Joiner struct {
+	Result db.Result
+	Query  *sqlgen.Statement
+	Join   sqlgen.Join
+}
+
+func (self *Joiner) On(terms ...interface{}) db.Result {
+	self.Join.On = terms
+	self.Query.Joins = append(self.Query.Joins, self.Join)
+	return self.Result
+}
+
+// Returns fields that select every column of the table, qualified by the
+// given table name or alias and named after it, as in "c.name AS c.name", so
+// they don't collide with the columns of joined tables.
+func (self *T) QualifiedFields(prefix string) []interface{} {
+	columns := make([]string, 0, len(self.ColumnTypes))
+
+	for column := range self.ColumnTypes {
+		columns = append(columns, column)
+	}
+
+	sort.Strings(columns)
+
+	fields := make([]interface{}, len(columns))
+
+	for i := range columns {
+		fields[i] = prefix + `.` + columns[i] + ` AS ` + prefix + `.` + columns[i]
+	}
+
+	return fields
 }
@@ -0,0 +1,358 @@
+/*
+  Copyright (c) 2012-2014 José Carlos Nieto, https://menteslibres.net/xiam
+
+  Permission is hereby granted, free of charge, to any person obtaining
+  a copy of this software and associated documentation files (the
+  "Software"), to deal in the Software without restriction, including
+  without limitation the rights to use, copy, modify, merge, publish,
+  distribute, sublicense, and/or sell copies of the Software, and to
+  permit persons to whom the Software is furnished to do so, subject to
+  the following conditions:
+
+  The above copyright notice and this permission notice shall be
+  included in all copies or substantial portions of the Software.
+
+  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+  EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+  MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+  NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+  LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+  OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+  WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+
+package sqlutil
+
+import (
+	"context"
+	"database/sql"
+	"upper.io/db"
+	"upper.io/db/util"
+	"upper.io/db/util/sqlgen"
+)
+
+type counter struct {
+	Total uint64 `field:"total"`
+}
+
+// Result set of the SQL adapters, see T.Find().
+type Result struct {
+	table  *T
+	source Source
+	// SELECT statement the result set is based on.
+	query sqlgen.Statement
+	// This is the main query cursor. It starts as a nil value.
+	cursor *sql.Rows
+}
+
+// Executes a SELECT statement that can feed Next(), All() or One().
+func (self *Result) setCursor() error {
+	var err error
+	// We need a cursor, if the cursor does not exists yet then we create one.
+	if self.cursor == nil {
+		query := self.query
+		if len(query.Joins) > 0 && len(query.Fields) == 0 {
+			if query.Fields, err = self.joinedFields(); err != nil {
+				return err
+			}
+		}
+		self.cursor, err = self.source.QueryStatement(&query)
+	}
+	return err
+}
+
+// Returns fields that select the columns of every joined table, qualified by
+// their table names or aliases so they don't collide.
+func (self *Result) joinedFields() ([]interface{}, error) {
+	fields := self.table.QualifiedFields(self.table.Name())
+
+	for _, join := range self.query.Joins {
+		name, alias := sqlgen.SplitAlias(join.Table)
+
+		col, err := self.source.Collection(name)
+		if err != nil {
+			return nil, err
+		}
+
+		if alias == "" {
+			alias = name
+		}
+
+		table, ok := col.(interface {
+			QualifiedFields(string) []interface{}
+		})
+		if ok == false {
+			return nil, db.ErrFeatureNotSupported
+		}
+
+		fields = append(fields, table.QualifiedFields(alias)...)
+	}
+
+	return fields, nil
+}
+
+// Determines the maximum limit of results to be returned.
+func (self *Result) Limit(n uint) db.Result {
+	self.query.Limit = int(n)
+	return self
+}
+
+// Determines how many documents will be skipped before starting to grab
+// results.
+func (self *Result) Skip(n uint) db.Result {
+	self.query.Offset = int(n)
+	return self
+}
+
+// Determines sorting of results according to the provided names. Fields may be
+// prefixed by - (minus) which means descending order, ascending order would be
+// used otherwise.
+func (self *Result) Sort(fields ...interface{}) db.Result {
+	self.query.OrderBy = fields
+	return self
+}
+
+// Retrieves only the given fields.
+func (self *Result) Select(fields ...interface{}) db.Result {
+	self.query.Fields = fields
+	return self
+}
+
+// Groups the results by the given fields.
+func (self *Result) Group(fields ...interface{}) db.Result {
+	self.query.GroupBy = fields
+	return self
+}
+
+// Filters the groups of the result set by the given conditions.
+func (self *Result) Having(terms ...interface{}) db.Result {
+	self.query.Having = terms
+	return self
+}
+
+// Retrieves only distinct rows of the given fields, or of the selected fields
+// if none are given.
+func (self *Result) Distinct(fields ...interface{}) db.Result {
+	if len(fields) > 0 {
+		self.query.Fields = fields
+	}
+	self.query.Distinct = true
+	return self
+}
+
+// Dumps the distinct values of the given field into a pointer to a slice.
+func (self *Result) DistinctValues(name string, dst interface{}) error {
+	if self.cursor != nil {
+		return db.ErrQueryIsPending
+	}
+
+	query := self.query
+	query.Fields = []interface{}{name}
+	query.Distinct = true
+
+	rows, err := self.source.QueryStatement(&query)
+	if err != nil {
+		return err
+	}
+
+	defer rows.Close()
+
+	err = self.table.FetchValues(dst, rows)
+
+	return util.ContextError(self.source.Context(), err)
+}
+
+// Joins the rows of another table, leaving out rows without a match.
+func (self *Result) Join(table string) db.Joiner {
+	return &Joiner{Result: self, Query: &self.query, Join: sqlgen.Join{Kind: sqlgen.InnerJoin, Table: table}}
+}
+
+// Joins the rows of another table, keeping rows without a match.
+func (self *Result) LeftJoin(table string) db.Joiner {
+	return &Joiner{Result: self, Query: &self.query, Join: sqlgen.Join{Kind: sqlgen.LeftJoin, Table: table}}
+}
+
+// Returns the query of this result set, so it can be the value of a condition.
+func (self *Result) Subquery() (*sqlgen.Statement, sqlgen.Dialect) {
+	query := self.query
+	return &query, self.source.Dialect()
+}
+
+// Runs the queries of this result set within the given context.
+func (self *Result) WithContext(ctx context.Context) db.Result {
+	self.source = self.source.WithContext(ctx).(Source)
+	return self
+}
+
+// Dumps all results into a pointer to an slice of structs or maps.
+func (self *Result) All(dst interface{}) error {
+	var err error
+
+	if self.cursor != nil {
+		return db.ErrQueryIsPending
+	}
+
+	// Current cursor.
+	err = self.setCursor()
+
+	if err != nil {
+		return err
+	}
+
+	defer self.Close()
+
+	// Fetching all results within the cursor.
+	err = self.table.fetcher().FetchRows(dst, self.cursor)
+
+	if err == nil {
+		self.Close()
+		err = util.FetchRelations(self.source.Context(), self.source, dst)
+	}
+
+	return util.ContextError(self.source.Context(), err)
+}
+
+// Fetches only one result from the resultset.
+func (self *Result) One(dst interface{}) error {
+	var err error
+
+	if self.cursor != nil {
+		return db.ErrQueryIsPending
+	}
+
+	defer self.Close()
+
+	err = self.Next(dst)
+
+	if err == nil {
+		self.Close()
+		err = util.FetchRelations(self.source.Context(), self.source, dst)
+	}
+
+	return err
+}
+
+// Fetches the next result from the resultset.
+func (self *Result) Next(dst interface{}) error {
+
+	var err error
+
+	// Current cursor.
+	err = self.setCursor()
+
+	if err != nil {
+		self.Close()
+		return err
+	}
+
+	// Fetching the next result from the cursor.
+	err = self.table.fetcher().FetchRow(dst, self.cursor)
+
+	if err != nil {
+		self.Close()
+	}
+
+	return util.ContextError(self.source.Context(), err)
+}
+
+// Removes the matching items from the collection.
+func (self *Result) Remove() error {
+	_, err := self.RemoveAffected()
+	return err
+}
+
+// Removes the matching items from the collection and returns the number of
+// rows that were deleted.
+func (self *Result) RemoveAffected() (uint64, error) {
+	res, err := self.source.ExecStatement(&sqlgen.Statement{
+		Type:       sqlgen.Delete,
+		Table:      self.query.Table,
+		Where:      self.query.Where,
+		PrimaryKey: self.query.PrimaryKey,
+	})
+
+	if err != nil {
+		return 0, err
+	}
+
+	return rowsAffected(res)
+}
+
+// Updates matching items from the collection with values of the given map or
+// struct.
+func (self *Result) Update(values interface{}) error {
+	_, err := self.UpdateAffected(values)
+	return err
+}
+
+// Updates matching items from the collection with values of the given map or
+// struct and returns the number of rows that matched.
+func (self *Result) UpdateAffected(values interface{}) (uint64, error) {
+
+	ff, vv, err := self.table.FieldValues(values, self.table.ConvertFn)
+
+	if err != nil {
+		return 0, err
+	}
+
+	res, err := self.source.ExecStatement(&sqlgen.Statement{
+		Type:       sqlgen.Update,
+		Table:      self.query.Table,
+		Columns:    ff,
+		Values:     vv,
+		Where:      self.query.Where,
+		PrimaryKey: self.query.PrimaryKey,
+	})
+
+	if err != nil {
+		return 0, err
+	}
+
+	return rowsAffected(res)
+}
+
+// Converts the number of affected rows reported by the driver.
+func rowsAffected(res sql.Result) (uint64, error) {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return uint64(n), nil
+}
+
+// Closes the result set.
+func (self *Result) Close() error {
+	var err error
+	if self.cursor != nil {
+		err = self.cursor.Close()
+		self.cursor = nil
+	}
+	return err
+}
+
+// Counts matching elements.
+func (self *Result) Count() (uint64, error) {
+
+	rows, err := self.source.QueryStatement(&sqlgen.Statement{
+		Type:       sqlgen.Count,
+		Table:      self.query.Table,
+		Joins:      self.query.Joins,
+		Fields:     self.query.Fields,
+		Distinct:   self.query.Distinct,
+		Where:      self.query.Where,
+		GroupBy:    self.query.GroupBy,
+		Having:     self.query.Having,
+		PrimaryKey: self.query.PrimaryKey,
+	})
+
+	if err != nil {
+		return 0, err
+	}
+
+	dst := counter{}
+	self.table.FetchRow(&dst, rows)
+
+	rows.Close()
+
+	return dst.Total, nil
+}